@@ -26,7 +26,7 @@ type Distribution struct {
 	Azure               *AzureImage  `yaml:"azure,omitempty"`
 	Docker              *DockerImage `yaml:"docker,omitempty"`
 	ISO                 *ISO         `yaml:"iso,omitempty"`
-	OVA                 *OVA         `yaml:"ova,omitempty`
+	OVA                 *OVA         `yaml:"ova,omitempty"`
 	Distribution        string       `yaml:"distribution,omitempty"`
 	DistributionRelease string       `yaml:"distribution_release,omitempty"`
 	DistributionVersion string       `yaml:"distribution_version,omitempty"`
@@ -18,16 +18,28 @@ package api
 
 import "io"
 
+// Executable is a provisioning step, e.g. a shell script or ansible playbook, that is
+// translated into the native form of the engine it is executed against
 type Executable interface {
 	Kind() string
 	Execute(image *Image, engine Executor) error
 }
 
+// Executor is implemented by each engine to collect the files and commands of provisioning steps
 type Executor interface {
+	// AddFile writes contents to path inside the image
 	AddFile(path string, contents io.Reader) error
 
+	// AddCommand runs each command using sh inside the image
 	AddCommand(command ...string) error
 }
+
+// AnsibleExecutor is implemented by engines that can run ansible playbooks natively
+// from the host, otherwise playbooks are copied into the image and run locally
+type AnsibleExecutor interface {
+	Executor
+	AddAnsiblePlaybook(playbook string, vars map[string]interface{}) error
+}
 type EngineHooks interface {
 	Before(engine Executor) error
 	After(engine Executor) error
@@ -17,16 +17,77 @@
 package executors
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
 	"sigs.k8s.io/image-builder/api"
 )
 
+// Ansible runs a playbook against the image, engines that do not implement
+// api.AnsibleExecutor run the playbook locally inside the image, which
+// requires ansible to already be installed.
 type Ansible struct {
+	// Playbook is the path to a local playbook
+	Playbook string `yaml:"playbook"`
+	// Dir is the directory containing the playbook and its roles, defaults to the directory of the playbook
+	Dir  string                 `yaml:"dir,omitempty"`
+	Vars map[string]interface{} `yaml:"vars,omitempty"`
+	// Index is the position of the step, so that playbooks do not overwrite each other
+	Index int `yaml:"-"`
 }
 
+// vcsDirs are not copied with the playbook
+var vcsDirs = map[string]bool{".git": true, ".hg": true, ".svn": true}
+
 func (ansible Ansible) Kind() string {
 	return "ansible"
 }
 
 func (ansible Ansible) Execute(image *api.Image, engine api.Executor) error {
-	return nil
+	if native, ok := engine.(api.AnsibleExecutor); ok {
+		return native.AddAnsiblePlaybook(ansible.Playbook, ansible.Vars)
+	}
+	dir := ansible.Dir
+	if dir == "" {
+		dir = filepath.Dir(ansible.Playbook)
+	}
+	playbook, err := filepath.Rel(dir, ansible.Playbook)
+	if err != nil || playbook == ".." || strings.HasPrefix(playbook, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("playbook %s must be inside %s", ansible.Playbook, dir)
+	}
+	dst := staged(ansible.Index, "ansible")
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && vcsDirs[info.Name()] {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, file)
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return engine.AddFile(path.Join(dst, filepath.ToSlash(rel)), f)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy playbook %s: %v", ansible.Playbook, err)
+	}
+	cmd := fmt.Sprintf("cd %s && ansible-playbook -i localhost, -c local %s", Quote(dst), Quote(filepath.ToSlash(playbook)))
+	if len(ansible.Vars) > 0 {
+		vars, err := json.Marshal(ansible.Vars)
+		if err != nil {
+			return fmt.Errorf("invalid ansible vars: %v", err)
+		}
+		cmd += " --extra-vars " + Quote(string(vars))
+	}
+	return engine.AddCommand(cmd)
 }
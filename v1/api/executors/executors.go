@@ -0,0 +1,77 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package executors
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"sigs.k8s.io/image-builder/api"
+)
+
+// stagingDir is where files needed by a step are copied to inside the image
+const stagingDir = "/tmp/image-builder"
+
+// staged returns the path that a file needed by the step at index is copied to inside the image
+func staged(index int, name string) string {
+	return path.Join(stagingDir, fmt.Sprintf("%d-%s", index, name))
+}
+
+// GetExecutable returns the provisioning step described by opts, index is the position of the step which is used
+// to stage its files separately from those of other steps
+func GetExecutable(index int, opts map[string]interface{}) (api.Executable, error) {
+	kind, _ := opts["kind"].(string)
+	switch kind {
+	case "shell":
+		shell := Shell{Index: index}
+		if err := decode(opts, &shell); err != nil {
+			return nil, err
+		}
+		return shell, nil
+	case "ansible":
+		ansible := Ansible{Index: index}
+		if err := decode(opts, &ansible); err != nil {
+			return nil, err
+		}
+		if ansible.Playbook == "" {
+			return nil, fmt.Errorf("ansible step must specify a playbook")
+		}
+		return ansible, nil
+	case "konfigadm":
+		return NewKonfigadm(opts)
+	}
+	return nil, fmt.Errorf("unknown step kind: %s, valid options are: shell,ansible,konfigadm", kind)
+}
+
+func decode(opts map[string]interface{}, into interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:          "yaml",
+		Result:           into,
+		WeaklyTypedInput: true,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(opts)
+}
+
+// Quote escapes s for use as a single argument in sh
+func Quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
@@ -17,17 +17,70 @@
 package executors
 
 import (
+	"bytes"
+	"fmt"
+	"sort"
+
 	_ "github.com/flanksource/konfigadm/pkg" // initialize konfigadm
+	konfigadm "github.com/flanksource/konfigadm/pkg/types"
+	"gopkg.in/flanksource/yaml.v3"
 	"sigs.k8s.io/image-builder/api"
 )
 
+// Konfigadm applies a konfigadm spec, the step accepts the same fields as the top-level konfigadm config
 type Konfigadm struct {
+	Config *konfigadm.Config
+}
+
+// NewKonfigadm parses opts as a konfigadm spec
+func NewKonfigadm(opts map[string]interface{}) (*Konfigadm, error) {
+	spec := make(map[string]interface{})
+	for k, v := range opts {
+		if k != "kind" {
+			spec[k] = v
+		}
+	}
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	config := &konfigadm.Config{}
+	config.Init()
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid konfigadm step: %v", err)
+	}
+	return &Konfigadm{Config: config}, nil
 }
 
-func (konfigadm Konfigadm) Kind() string {
+func (k Konfigadm) Kind() string {
 	return "konfigadm"
 }
 
-func (konfigadm Konfigadm) Execute(image *api.Image, engine api.Executor) error {
+func (k Konfigadm) Execute(image *api.Image, engine api.Executor) error {
+	files, commands, err := k.Config.ApplyPhases()
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		file := files[path]
+		if err := engine.AddFile(path, bytes.NewBufferString(file.Content)); err != nil {
+			return err
+		}
+		if file.Permissions != "" {
+			if err := engine.AddCommand(fmt.Sprintf("chmod %s %s", file.Permissions, Quote(path))); err != nil {
+				return err
+			}
+		}
+	}
+	for _, cmd := range commands {
+		if err := engine.AddCommand(cmd.Cmd); err != nil {
+			return err
+		}
+	}
 	return nil
 }
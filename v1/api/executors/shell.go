@@ -17,11 +17,20 @@
 package executors
 
 import (
+	"fmt"
+	"os"
+	"path"
+
 	"sigs.k8s.io/image-builder/api"
 )
 
+// Shell runs a list of commands and/or a local script inside the image
 type Shell struct {
-	Commands []string
+	Commands []string `yaml:"commands,omitempty"`
+	// Script is the path to a local script that is copied into the image and run
+	Script string `yaml:"script,omitempty"`
+	// Index is the position of the step, so that scripts with the same name do not overwrite each other
+	Index int `yaml:"-"`
 }
 
 func (shell Shell) Kind() string {
@@ -29,5 +38,22 @@ func (shell Shell) Kind() string {
 }
 
 func (shell Shell) Execute(image *api.Image, engine api.Executor) error {
-	return nil
+	if shell.Script != "" {
+		script, err := os.Open(shell.Script)
+		if err != nil {
+			return fmt.Errorf("failed to open script %s: %v", shell.Script, err)
+		}
+		defer script.Close()
+		dst := staged(shell.Index, path.Base(shell.Script))
+		if err := engine.AddFile(dst, script); err != nil {
+			return err
+		}
+		if err := engine.AddCommand("sh " + Quote(dst)); err != nil {
+			return err
+		}
+	}
+	if len(shell.Commands) == 0 {
+		return nil
+	}
+	return engine.AddCommand(shell.Commands...)
 }
@@ -0,0 +1,111 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	FirmwareBIOS = "bios"
+	FirmwareEFI  = "efi"
+)
+
+var (
+	DiskControllers = []string{"lsilogic", "lsilogicsas", "pvscsi", "buslogic", "ide", "sata", "nvme"}
+	NICs            = []string{"vmxnet3", "e1000", "e1000e"}
+)
+
+// Hardware describes the virtual hardware of a VMware virtual machine
+type Hardware struct {
+	CPUs           int `yaml:"cpus,omitempty"`
+	CoresPerSocket int `yaml:"cores_per_socket,omitempty"`
+	// Memory in MB
+	Memory int `yaml:"memory,omitempty"`
+	// DiskController is one of lsilogic, lsilogicsas, pvscsi, buslogic, ide, sata or nvme
+	DiskController string `yaml:"disk_controller,omitempty"`
+	// NIC is the network adapter type, one of vmxnet3, e1000 or e1000e
+	NIC string `yaml:"nic,omitempty"`
+	// Firmware is either bios or efi
+	Firmware string `yaml:"firmware,omitempty"`
+	// Version is the virtual hardware version, e.g. 13 for ESXi 6.5
+	Version int `yaml:"version,omitempty"`
+	// GuestOS is the VMware guest identifier, e.g. ubuntu64Guest
+	GuestOS string `yaml:"guest_os,omitempty"`
+	// ExtraConfig contains additional vmx keys, these take precedence over any typed fields
+	ExtraConfig map[string]string `yaml:"extra_config,omitempty"`
+}
+
+// WithDefaults returns a copy of the hardware with any unset fields set to their defaults
+func (h Hardware) WithDefaults() Hardware {
+	if h.CPUs == 0 {
+		h.CPUs = 2
+	}
+	if h.CoresPerSocket == 0 {
+		h.CoresPerSocket = h.CPUs
+	}
+	if h.Memory == 0 {
+		h.Memory = 2048
+	}
+	if h.DiskController == "" {
+		h.DiskController = "lsilogic"
+	}
+	if h.NIC == "" {
+		h.NIC = "vmxnet3"
+	}
+	if h.Firmware == "" {
+		h.Firmware = FirmwareBIOS
+	}
+	if h.Version == 0 {
+		h.Version = 11
+	}
+	if h.GuestOS == "" {
+		h.GuestOS = "other3xLinux64Guest"
+	}
+	return h
+}
+
+func (h Hardware) IsEmpty() bool {
+	return h.CPUs == 0 && h.CoresPerSocket == 0 && h.Memory == 0 && h.DiskController == "" && h.NIC == "" &&
+		h.Firmware == "" && h.Version == 0 && h.GuestOS == "" && len(h.ExtraConfig) == 0
+}
+
+func (h Hardware) Validate() error {
+	if h.CPUs > 0 && h.CoresPerSocket > 0 && h.CPUs%h.CoresPerSocket != 0 {
+		return fmt.Errorf("cpus (%d) must be a multiple of cores_per_socket (%d)", h.CPUs, h.CoresPerSocket)
+	}
+	if h.DiskController != "" && !contains(DiskControllers, h.DiskController) {
+		return fmt.Errorf("unknown disk_controller %s, valid options are: %s", h.DiskController, strings.Join(DiskControllers, ","))
+	}
+	if h.NIC != "" && !contains(NICs, h.NIC) {
+		return fmt.Errorf("unknown nic %s, valid options are: %s", h.NIC, strings.Join(NICs, ","))
+	}
+	if h.Firmware != "" && h.Firmware != FirmwareBIOS && h.Firmware != FirmwareEFI {
+		return fmt.Errorf("unknown firmware %s, valid options are: bios,efi", h.Firmware)
+	}
+	return nil
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -33,15 +33,22 @@ type Image interface {
 }
 
 const (
-	AMIKind         = "ami"
-	AzureKind       = "azure"
-	DiskImageKind   = "img"
-	DockerImageKind = "docker"
-	GCEImageKind    = "gce"
-	OVAKind         = "ova"
-	ISOKind         = "iso"
-	VMKind          = "vm"
-	VMDKKind        = "vmdk"
+	AMIKind          = "ami"
+	AzureKind        = "azure"
+	DigitalOceanKind = "digitalocean"
+	DiskImageKind    = "img"
+	DockerImageKind  = "docker"
+	GCEImageKind     = "gce"
+	OCIKind          = "oci"
+	OVAKind          = "ova"
+	ISOKind          = "iso"
+	RawImageKind     = "raw"
+	RegistryKind     = "registry"
+	RootFSKind       = "rootfs"
+	VHDKind          = "vhd"
+	VHDXKind         = "vhdx"
+	VMKind           = "vm"
+	VMDKKind         = "vmdk"
 )
 
 type AMI struct {
@@ -53,6 +60,8 @@ type AMI struct {
 	Owners      []string               `yaml:"owners,omitempty" structs:"owners,omitempty" json:"owners,omitempty"`
 	SSHUsername string                 `structs:"ssh_username,omitempty" yaml:"ssh_username,omitempty" json:"ssh_username,omitempty"`
 	Filters     map[string]interface{} `structs:"source_ami_filter,omitempty" yaml:"source_ami_filter,omitempty" json:"source_ami_filter,omitempty"`
+	// Regions maps each region the AMI was copied to, to the ID of the AMI in that region
+	Regions map[string]string `yaml:"regions,omitempty" json:"regions,omitempty"`
 }
 
 func (i AMI) Kind() string {
@@ -63,7 +72,13 @@ func (i AMI) String() string {
 	return i.ID
 }
 func (i AMI) GetPackerOptions() (PackerBuilderOptions, error) {
-	return encode(i)
+	opts, err := encode(i)
+	if err != nil {
+		return nil, err
+	}
+	// regions are an output of a build, use ami_regions to copy an AMI
+	delete(opts, "regions")
+	return opts, nil
 }
 
 func (i AMI) GetQemuOptions() (*QemuOptions, error) {
@@ -82,6 +97,9 @@ func (i AzureImage) Kind() string {
 }
 
 func (i AzureImage) String() string {
+	if i.ID != "" {
+		return i.ID
+	}
 	return AzureKind
 }
 
@@ -93,6 +111,28 @@ func (i AzureImage) GetQemuOptions() (*QemuOptions, error) {
 	return nil, nil
 }
 
+// DigitalOceanImage is a droplet snapshot
+type DigitalOceanImage struct {
+	ID      string   `yaml:"id,omitempty" json:"image,omitempty"`
+	Regions []string `yaml:"regions,omitempty" json:"-"`
+}
+
+func (i DigitalOceanImage) Kind() string {
+	return DigitalOceanKind
+}
+
+func (i DigitalOceanImage) String() string {
+	return i.ID
+}
+
+func (i DigitalOceanImage) GetPackerOptions() (PackerBuilderOptions, error) {
+	return encode(i)
+}
+
+func (i DigitalOceanImage) GetQemuOptions() (*QemuOptions, error) {
+	return nil, nil
+}
+
 type DiskImage struct {
 	URL            string `yaml:"url,omitempty" structs:"iso_url,omitempty"`
 	Checksum       string `yaml:"checksum,omitempty" structs:"iso_checksum,omitempty"`
@@ -102,6 +142,16 @@ type DiskImage struct {
 	Inline         bool   `yaml:"inline,omitempty"`
 	OutputDir      string `yaml:"output_dir,omitempty"`
 	OutputFilename string `yaml:"output_filename,omitempty"`
+	// Compact zero-fills free space before shutdown and converts the disk into a compressed qcow2
+	Compact bool `yaml:"compact,omitempty"`
+	// Overlay builds against a qcow2 overlay of the base image instead of a full copy, either flatten or layered
+	Overlay string `yaml:"overlay,omitempty"`
+	// SizeGB is the size of a disk built from a container image or rootfs, defaults to the size of the rootfs with room to grow
+	SizeGB int `yaml:"size_gb,omitempty"`
+	// Bootloader installed on a disk built from a container image or rootfs, either grub or systemd-boot, defaults to grub
+	Bootloader string `yaml:"bootloader,omitempty"`
+	// KernelArgs are added to the kernel command line of a disk built from a container image or rootfs
+	KernelArgs string `yaml:"kernel_args,omitempty"`
 }
 
 func (i DiskImage) Kind() string {
@@ -124,6 +174,10 @@ type DockerImage struct {
 	Image    string `yaml:"image,omitempty" `
 	Tag      string `yaml:"tag,omitempty" `
 	Checksum string `yaml:"checksum,omitempty" `
+	// Digests maps each platform of a multi-platform build to the digest of its image manifest
+	Digests map[string]string `yaml:"digests,omitempty"`
+	// Archive is the OCI image layout of a multi-platform build, which cannot be loaded into the docker daemon
+	Archive string `yaml:"archive,omitempty"`
 }
 
 func (i DockerImage) GetPackerOptions() (PackerBuilderOptions, error) {
@@ -155,6 +209,10 @@ func (i GCEImage) Kind() string {
 	return GCEImageKind
 }
 
+func (i GCEImage) String() string {
+	return i.ImageName
+}
+
 func (i GCEImage) GetPackerOptions() (PackerBuilderOptions, error) {
 	return encode(i)
 }
@@ -189,6 +247,7 @@ func (i ISO) GetQemuOptions() (*QemuOptions, error) {
 
 type OVA struct {
 	URL        string
+	Hardware   Hardware          `yaml:"hardware,omitempty"`
 	Properties map[string]string `yaml:"properties,omitempty"`
 	EULA       string            `yaml:"eula,omitempty"`
 }
@@ -214,6 +273,8 @@ type VM struct {
 	Name    string            `yaml:"name,omitempty" structs:"name,omitempty" json:"name,omitempty"`
 	ID      string            `yaml:"id,omitempty" structs:"owners,omitempty" json:"id,omitempty"`
 	Network string            `yaml:"network,omitempty"`
+	// Hardware overrides the hardware of the imported OVA
+	Hardware Hardware `yaml:"hardware,omitempty" json:"-"`
 }
 
 func (i VM) Kind() string {
@@ -252,6 +313,149 @@ func (i VMDK) GetQemuOptions() (*QemuOptions, error) {
 	return nil, nil
 }
 
+type RawImage struct {
+	URL string `yaml:"url,omitempty"`
+}
+
+func (i RawImage) Kind() string {
+	return RawImageKind
+}
+
+func (i RawImage) String() string {
+	return i.URL
+}
+
+func (i RawImage) GetPackerOptions() (PackerBuilderOptions, error) {
+	return encode(i)
+}
+
+func (i RawImage) GetQemuOptions() (*QemuOptions, error) {
+	return nil, nil
+}
+
+// VHD is a fixed size Virtual Hard Disk, as used by Azure
+type VHD struct {
+	URL string `yaml:"url,omitempty"`
+}
+
+func (i VHD) Kind() string {
+	return VHDKind
+}
+
+func (i VHD) String() string {
+	return i.URL
+}
+
+func (i VHD) GetPackerOptions() (PackerBuilderOptions, error) {
+	return encode(i)
+}
+
+func (i VHD) GetQemuOptions() (*QemuOptions, error) {
+	return nil, nil
+}
+
+// VHDX is a dynamically sized Hyper-V virtual disk
+type VHDX struct {
+	URL string `yaml:"url,omitempty"`
+}
+
+func (i VHDX) Kind() string {
+	return VHDXKind
+}
+
+func (i VHDX) String() string {
+	return i.URL
+}
+
+func (i VHDX) GetPackerOptions() (PackerBuilderOptions, error) {
+	return encode(i)
+}
+
+func (i VHDX) GetQemuOptions() (*QemuOptions, error) {
+	return nil, nil
+}
+
+// OCIImage is a container image saved as an OCI image layout tarball
+type OCIImage struct {
+	URL string `yaml:"url,omitempty"`
+	// Ref is the tag of the image in the layout index, defaults to the tag of the docker image
+	Ref string `yaml:"ref,omitempty"`
+	// Digest of the image manifest
+	Digest string `yaml:"digest,omitempty"`
+}
+
+func (i OCIImage) Kind() string {
+	return OCIKind
+}
+
+func (i OCIImage) String() string {
+	return i.URL
+}
+
+func (i OCIImage) GetPackerOptions() (PackerBuilderOptions, error) {
+	return encode(i)
+}
+
+func (i OCIImage) GetQemuOptions() (*QemuOptions, error) {
+	return nil, nil
+}
+
+// RootFS is a root filesystem, e.g. created by debootstrap or dnf --installroot, either as a directory or a tarball
+type RootFS struct {
+	URL string `yaml:"url,omitempty"`
+}
+
+func (i RootFS) Kind() string {
+	return RootFSKind
+}
+
+func (i RootFS) String() string {
+	return i.URL
+}
+
+func (i RootFS) GetPackerOptions() (PackerBuilderOptions, error) {
+	return encode(i)
+}
+
+func (i RootFS) GetQemuOptions() (*QemuOptions, error) {
+	return nil, nil
+}
+
+// Registry is a container image pushed to a registry
+type Registry struct {
+	// Repository including the registry host, e.g. registry.example.com/team/image, defaults to Docker Hub without a host
+	Repository string `yaml:"repository,omitempty"`
+	// Tags to push, defaults to the tag of the image
+	Tags []string `yaml:"tags,omitempty"`
+	// Username and Password default to REGISTRY_USERNAME and REGISTRY_PASSWORD, and then to the docker client config,
+	// they are never included in the build history
+	Username string `yaml:"username,omitempty" json:"-"`
+	Password string `yaml:"password,omitempty" json:"-"`
+	// Insecure pushes using plain HTTP, which is always used for localhost
+	Insecure bool `yaml:"insecure,omitempty"`
+	// Digest of the pushed image
+	Digest string `yaml:"digest,omitempty"`
+}
+
+func (i Registry) Kind() string {
+	return RegistryKind
+}
+
+func (i Registry) String() string {
+	if i.Digest != "" {
+		return i.Repository + "@" + i.Digest
+	}
+	return i.Repository
+}
+
+func (i Registry) GetPackerOptions() (PackerBuilderOptions, error) {
+	return encode(i)
+}
+
+func (i Registry) GetQemuOptions() (*QemuOptions, error) {
+	return nil, nil
+}
+
 func GetImage(opts map[string]interface{}) (Image, error) {
 	// FIXME mapstructure requires a concrete type, when passed a value referenced by
 	// an interface it does not decode anything.
@@ -298,6 +502,42 @@ func GetImage(opts map[string]interface{}) (Image, error) {
 			return nil, err
 		}
 		return driver, nil
+	case "raw":
+		driver := RawImage{}
+		if err := decode(opts, &driver); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	case "vhd":
+		driver := VHD{}
+		if err := decode(opts, &driver); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	case "vhdx":
+		driver := VHDX{}
+		if err := decode(opts, &driver); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	case "oci":
+		driver := OCIImage{}
+		if err := decode(opts, &driver); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	case "registry":
+		driver := Registry{}
+		if err := decode(opts, &driver); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	case "rootfs":
+		driver := RootFS{}
+		if err := decode(opts, &driver); err != nil {
+			return nil, err
+		}
+		return driver, nil
 	case "iso":
 		driver := ISO{}
 		if err := decode(opts, &driver); err != nil {
@@ -310,6 +550,12 @@ func GetImage(opts map[string]interface{}) (Image, error) {
 			return nil, err
 		}
 		return driver, nil
+	case "digitalocean":
+		driver := DigitalOceanImage{}
+		if err := decode(opts, &driver); err != nil {
+			return nil, err
+		}
+		return driver, nil
 	}
 	return nil, fmt.Errorf("unknown input kind %s", opts["kind"])
 }
@@ -394,6 +640,42 @@ func Merge(input Image, from Image) (Image, error) {
 			return nil, err
 		}
 		return vmdk, nil
+	case RawImage:
+		raw := input.(RawImage)
+		if err := mergo.Merge(&raw, from.(RawImage)); err != nil {
+			return nil, err
+		}
+		return raw, nil
+	case VHD:
+		vhd := input.(VHD)
+		if err := mergo.Merge(&vhd, from.(VHD)); err != nil {
+			return nil, err
+		}
+		return vhd, nil
+	case VHDX:
+		vhdx := input.(VHDX)
+		if err := mergo.Merge(&vhdx, from.(VHDX)); err != nil {
+			return nil, err
+		}
+		return vhdx, nil
+	case OCIImage:
+		oci := input.(OCIImage)
+		if err := mergo.Merge(&oci, from.(OCIImage)); err != nil {
+			return nil, err
+		}
+		return oci, nil
+	case Registry:
+		registry := input.(Registry)
+		if err := mergo.Merge(&registry, from.(Registry)); err != nil {
+			return nil, err
+		}
+		return registry, nil
+	case RootFS:
+		rootfs := input.(RootFS)
+		if err := mergo.Merge(&rootfs, from.(RootFS)); err != nil {
+			return nil, err
+		}
+		return rootfs, nil
 	case VM:
 		vm := input.(VM)
 		if err := mergo.Merge(&vm, from.(VM)); err != nil {
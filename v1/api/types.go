@@ -17,12 +17,109 @@
 package api
 
 import (
+	"fmt"
+
 	konfigadm "github.com/flanksource/konfigadm/pkg/types"
 )
 
 type PackerEngine struct {
 	Version  string                            `yaml:"version"`
 	Builders map[string]map[string]interface{} `yaml:"builders,omitempty"`
+	// Format of the generated template, either json or hcl, defaults to hcl for packer >= 1.7.0
+	Format string `yaml:"format,omitempty"`
+	// Playbook is one of the embedded CAPI playbooks e.g. node.yml, that is run using the ansible provisioner
+	Playbook string `yaml:"playbook,omitempty"`
+	// AnsibleVars override the variables derived from the kubernetes and container_runtime config
+	AnsibleVars map[string]interface{} `yaml:"ansible_vars,omitempty"`
+}
+
+// QemuEngine configures the VM that the qemu engine boots to configure an image
+type QemuEngine struct {
+	// CPUs defaults to 2
+	CPUs int `yaml:"cpus,omitempty"`
+	// Memory in MB, defaults to 1024
+	Memory int `yaml:"memory,omitempty"`
+	// Accel is one of kvm, hvf or tcg, defaults to kvm (hvf on macOS) falling back to tcg when unavailable
+	Accel string `yaml:"accel,omitempty"`
+	// CPU model, defaults to host when hardware accelerated and max otherwise
+	CPU string `yaml:"cpu,omitempty"`
+	// DiskInterface is one of virtio, ide or scsi, defaults to virtio
+	DiskInterface string `yaml:"disk_interface,omitempty"`
+	// Firmware is either bios or uefi, defaults to bios
+	Firmware string `yaml:"firmware,omitempty"`
+	// OVMF is the path to the UEFI firmware, defaults to the first OVMF image found in the usual locations
+	OVMF string `yaml:"ovmf,omitempty"`
+	// SSHPort is the host port forwarded to port 22 of the VM, defaults to a free port
+	SSHPort int `yaml:"ssh_port,omitempty"`
+	// ExtraArgs are appended to the qemu command line
+	ExtraArgs []string `yaml:"extra_args,omitempty"`
+	// Timeout is the maximum duration of the build before the VM is killed, defaults to 1h
+	Timeout string `yaml:"timeout,omitempty"`
+	// ConsoleLog is the file the serial console is written to, defaults to <image>-console.log
+	ConsoleLog string `yaml:"console_log,omitempty"`
+	// Mode is either cloud-init or ssh, cloud-init provisions the VM using a one-shot seed while ssh
+	// boots the VM with an ephemeral key and runs the provisioning steps over SSH, defaults to cloud-init
+	Mode string `yaml:"mode,omitempty"`
+	// NetworkConfig is written to the network-config of the cloud-init seed, e.g. to configure static networking
+	NetworkConfig map[string]interface{} `yaml:"network_config,omitempty"`
+	// VendorData is written to the vendor-data of the cloud-init seed, either as a string or as #cloud-config
+	VendorData interface{} `yaml:"vendor_data,omitempty"`
+}
+
+// GetQemuEngine decodes the engine section of a config
+func GetQemuEngine(opts map[string]interface{}) (QemuEngine, error) {
+	engine := QemuEngine{}
+	if err := decode(opts, &engine); err != nil {
+		return engine, fmt.Errorf("invalid qemu engine: %v", err)
+	}
+	return engine, nil
+}
+
+// DockerEngine is the configuration of the docker engine
+type DockerEngine struct {
+	// Platforms to build for using docker buildx, e.g. linux/amd64 and linux/arm64, defaults to the host platform
+	Platforms []string `yaml:"platforms,omitempty"`
+}
+
+// GetDockerEngine decodes the engine section of a config
+func GetDockerEngine(opts map[string]interface{}) (DockerEngine, error) {
+	engine := DockerEngine{}
+	if err := decode(opts, &engine); err != nil {
+		return engine, fmt.Errorf("invalid docker engine: %v", err)
+	}
+	return engine, nil
+}
+
+// RootfsEngine is the configuration of the rootfs engine
+type RootfsEngine struct {
+	// Runner is one of bwrap, proot or chroot, defaults to the first one found, chroot requires root
+	Runner string `yaml:"runner,omitempty"`
+}
+
+// GetRootfsEngine decodes the engine section of a config
+func GetRootfsEngine(opts map[string]interface{}) (RootfsEngine, error) {
+	engine := RootfsEngine{}
+	if err := decode(opts, &engine); err != nil {
+		return engine, fmt.Errorf("invalid rootfs engine: %v", err)
+	}
+	return engine, nil
+}
+
+// ChrootEngine is the configuration of the chroot engine
+type ChrootEngine struct {
+	// Device is used to attach the disk, either loop or nbd, defaults to loop for raw images and nbd for qcow2
+	Device string `yaml:"device,omitempty"`
+	// Partition is the number of the root partition, defaults to the first partition containing /etc/os-release
+	Partition int `yaml:"partition,omitempty"`
+}
+
+// GetChrootEngine decodes the engine section of a config
+func GetChrootEngine(opts map[string]interface{}) (ChrootEngine, error) {
+	engine := ChrootEngine{}
+	if err := decode(opts, &engine); err != nil {
+		return engine, fmt.Errorf("invalid chroot engine: %v", err)
+	}
+	return engine, nil
 }
 
 // packer build options are too many sync
@@ -43,6 +140,10 @@ type KubernetesConfiguration struct {
 
 	Engine map[string]interface{} `yaml:"engine,omitempty"`
 
+	// Steps are provisioning steps of kind shell, ansible or konfigadm that are run in order
+	// after the top-level konfigadm config has been applied
+	Steps []map[string]interface{} `yaml:"steps,omitempty"`
+
 	// The version of kubernetes to install
 	Version string `yaml:"version,omitempty" json:"version,omitempty"`
 }
@@ -17,8 +17,10 @@ limitations under the License.
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -34,9 +36,11 @@ import (
 	"github.com/spf13/cobra"
 	"gopkg.in/flanksource/yaml.v3"
 	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/api/executors"
 	"sigs.k8s.io/image-builder/pkg"
 	"sigs.k8s.io/image-builder/pkg/distros"
 	"sigs.k8s.io/image-builder/pkg/engines"
+	"sigs.k8s.io/image-builder/pkg/history"
 
 	"sigs.k8s.io/image-builder/pkg/converters"
 	"sigs.k8s.io/image-builder/pkg/resources"
@@ -164,6 +168,15 @@ func getContext(cmd *cobra.Command, args []string) (*pkg.BuildContext, error) {
 		outputs = append(outputs, output)
 	}
 
+	var steps []api.Executable
+	for i, opts := range config.Steps {
+		step, err := executors.GetExecutable(i, opts)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+
 	engine, err := getEngine(config)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "unable to parse engine")
@@ -199,6 +212,7 @@ func getContext(cmd *cobra.Command, args []string) (*pkg.BuildContext, error) {
 		Config:   *config,
 		Defaults: defaults,
 		DryRun:   dryRun,
+		Steps:    steps,
 		Logger:   logger.StandardLogger(),
 	}
 	ctx.Tracef("distro=%v input=%+v outputs=%v", distro, input, outputs)
@@ -225,37 +239,143 @@ var Build = cobra.Command{
 			return fmt.Errorf("Unsupported OS by konfigadm: %v, supported os: %v", ctx.Distro.GetDistribution().OS, names)
 		} else {
 			ctx.Config.Konfigadm.Context.Flags = os.GetTags()
+			for _, step := range ctx.Steps {
+				if k, ok := step.(*executors.Konfigadm); ok {
+					k.Config.Context.Flags = os.GetTags()
+				}
+			}
+		}
+		if ctx.DryRun {
+			return plan(ctx)
+		}
+
+		extras, _ := cmd.Flags().GetStringSlice("extras")
+		record, err := history.New(configFile, extras)
+		if err != nil {
+			return err
+		}
+		record.Distro = ctx.Config.DistroName
+		record.Engine = ctx.Engine.Kind()
+		record.Input = history.NewImage(ctx.Input)
+		err = build(ctx, record)
+		dir := history.Dir(stateDir)
+		if err := record.Finish(dir, err); err != nil {
+			logger.Warnf("Failed to save build record to %s: %v", dir, err)
+		} else {
+			logger.Infof("Build %s recorded in %s", record.ID, dir)
 		}
-		// Configures an image and returns the result or an error
-		outputImage, err := ctx.Engine.Configure(*ctx)
 		if err != nil {
 			return err
 		}
+		// print image output so that it can be used directly in scripts e.g $(image-builder build)
+		return printImage(ctx.Input)
+	},
+}
 
-		// once configured, the output becomes the input into the processing chain
-		ctx.Input = outputImage
+// printImage prints the image to stdout, AMIs are always printed as a JSON map of region to AMI ID so that the
+// output has the same shape however many regions the AMI was copied to
+func printImage(image api.Image) error {
+	if ami, ok := image.(api.AMI); ok {
+		regions := ami.Regions
+		if len(regions) == 0 {
+			regions = map[string]string{ami.Region: ami.ID}
+		}
+		data, err := json.Marshal(regions)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Printf("%s", image)
+	return nil
+}
 
-		for _, output := range ctx.Output {
-			logger.Infof("Converting %s to %s", ctx.Input, output)
+// plan prints the conversion chain for each output without configuring or converting anything
+func plan(ctx *pkg.BuildContext) error {
+	outputImage, err := ctx.Engine.Configure(*ctx)
+	if err != nil {
+		return err
+	}
+	// engines may not return an image during a dry-run, so plan using the input kind
+	kind := ctx.Input.Kind()
+	if outputImage != nil {
+		kind = outputImage.Kind()
+	}
+	for _, output := range ctx.Output {
+		path, err := converters.FindPath(kind, output.Kind())
+		if err != nil {
+			return err
+		}
+		if len(path) > 0 {
+			fmt.Printf("Conversion: %s\n", path)
+		}
+		kind = output.Kind()
+	}
+	return nil
+}
+
+// build configures the input image and converts it into each output, recording each step
+func build(ctx *pkg.BuildContext, record *history.Record) error {
+	var outputImage api.Image
+	err := record.Step("configure", func() error {
+		var err error
+		// Configures an image and returns the result or an error
+		outputImage, err = ctx.Engine.Configure(*ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if outputImage == nil {
+		return fmt.Errorf("empty image created")
+	}
+	record.Configured = history.NewImage(outputImage)
+
+	// once configured, the output becomes the input into the processing chain
+	ctx.Input = outputImage
+
+	for _, output := range ctx.Output {
+		path, err := converters.FindPath(ctx.Input.Kind(), output.Kind())
+		if err != nil {
+			return err
+		}
+		for _, converter := range path {
+			record.Chain = append(record.Chain, converter.String())
+		}
+		logger.Infof("Converting %s to %s", ctx.Input, output)
+		err = record.Step(fmt.Sprintf("convert %s", output.Kind()), func() error {
 			// Converts an image to the target type
 			converted, err := converters.Convert(ctx, ctx.Input, output)
 			if err != nil {
 				return err
 			}
 			ctx.Input = converted
-		}
-		if ctx.DryRun {
 			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := record.AddOutput(ctx.Input); err != nil {
+			return fmt.Errorf("failed to record output %s: %v", ctx.Input, err)
 		}
+	}
 
-		if ctx.Input == nil {
-			logger.Fatalf("empty image created")
+	if ctx.Input == nil {
+		return fmt.Errorf("empty image created")
+	}
+	logger.Infof("Created new image: %s", ctx.Input)
+	if ami, ok := ctx.Input.(api.AMI); ok {
+		var regions []string
+		for region := range ami.Regions {
+			regions = append(regions, region)
 		}
-		logger.Infof("Created new image: %s", ctx.Input)
-		// print image output so that it can be used directly in scripts e.g $(image-builder build)
-		fmt.Printf("%s", ctx.Input)
-		return nil
-	},
+		sort.Strings(regions)
+		for _, region := range regions {
+			logger.Infof("%s: %s", region, ami.Regions[region])
+		}
+	}
+	return nil
 }
 
 var configFile []string
@@ -264,7 +384,7 @@ func init() {
 
 	Engines = make(map[string]pkg.Engine)
 
-	for _, engine := range []pkg.Engine{engines.Qemu{}, engines.Docker{}, engines.Packer{}, engines.NullEngine} {
+	for _, engine := range []pkg.Engine{engines.Qemu{}, engines.Docker{}, engines.Packer{}, engines.Rootfs{}, engines.Chroot{}, engines.NullEngine} {
 		Engines[engine.Kind()] = engine
 	}
 	logger.Tracef("Engines: %s", Engines)
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/image-builder/pkg/cache"
+)
+
+var cacheDir string
+
+var Cache = cobra.Command{
+	Use:   "cache",
+	Short: "Inspect, prune and pre-seed the cache of downloaded images",
+}
+
+var cacheList = cobra.Command{
+	Use:   "list",
+	Short: "List cached images, most recently used first",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := cache.New(cacheDir).Entries()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 3, 2, 3, ' ', 0)
+		fmt.Fprintf(w, "DIGEST\tNAME\tSIZE\tLAST USED\tURL\n")
+		var total int64
+		for _, entry := range entries {
+			total += entry.Size
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", shortDigest(entry.Digest), path.Base(entry.URL), cache.FormatSize(entry.Size),
+				entry.LastUsed.Format(time.RFC3339), entry.URL)
+		}
+		fmt.Fprintf(w, "\t\t%s\t\t\n", cache.FormatSize(total))
+		return w.Flush()
+	},
+}
+
+var cachePrune = cobra.Command{
+	Use:   "prune",
+	Short: "Remove images unused for longer than --older-than, and then the least recently used until the cache fits in --max-size",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		olderThan, _ := cmd.Flags().GetDuration("older-than")
+		all, _ := cmd.Flags().GetBool("all")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		var maxSize int64
+		if size, _ := cmd.Flags().GetString("max-size"); size != "" {
+			var err error
+			if maxSize, err = cache.ParseSize(size); err != nil {
+				return err
+			}
+		}
+		if all {
+			olderThan = time.Nanosecond
+		} else if olderThan == 0 && maxSize == 0 {
+			return fmt.Errorf("one of --older-than, --max-size or --all is required")
+		}
+		removed, err := cache.New(cacheDir).Prune(olderThan, maxSize, dryRun)
+		action := "Removed"
+		if dryRun {
+			action = "Would remove"
+		}
+		var freed int64
+		for _, entry := range removed {
+			freed += entry.Size
+			logger.Infof("%s %s %s (%s)", action, shortDigest(entry.Digest), entry.URL, cache.FormatSize(entry.Size))
+		}
+		logger.Infof("%s %d images, %s", action, len(removed), cache.FormatSize(freed))
+		return err
+	},
+}
+
+var cacheExport = cobra.Command{
+	Use:   "export <file> [digest...]",
+	Short: "Export cached images to a tar archive, or to stdout if file is -, defaults to all images",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := cache.New(cacheDir)
+		var entries []cache.Entry
+		if len(args) > 1 {
+			for _, digest := range args[1:] {
+				entry, err := c.Get(digest)
+				if err != nil {
+					return fmt.Errorf("image %s not found in cache: %v", digest, err)
+				}
+				entries = append(entries, *entry)
+			}
+		} else {
+			var err error
+			if entries, err = c.Entries(); err != nil {
+				return err
+			}
+		}
+		var w io.Writer = os.Stdout
+		if args[0] != "-" {
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := c.Export(w, entries); err != nil {
+			return err
+		}
+		logger.Infof("Exported %d images", len(entries))
+		return nil
+	},
+}
+
+var cacheImport = cobra.Command{
+	Use:   "import <file>",
+	Short: "Import images from an archive created by export, or from stdin if file is -",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		entries, err := cache.New(cacheDir).Import(r)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			logger.Infof("Imported %s %s (%s)", shortDigest(entry.Digest), entry.URL, cache.FormatSize(entry.Size))
+		}
+		return nil
+	},
+}
+
+// shortDigest returns the first 12 characters of a sha256 digest
+func shortDigest(digest string) string {
+	if len(digest) > len("sha256:")+12 {
+		return digest[len("sha256:") : len("sha256:")+12]
+	}
+	return digest
+}
+
+func init() {
+	cachePrune.Flags().Duration("older-than", 0, "Remove images that have not been used for this long, e.g. 720h")
+	cachePrune.Flags().String("max-size", "", "Remove the least recently used images until the cache is no larger than this, e.g. 20GB")
+	cachePrune.Flags().Bool("all", false, "Remove all images")
+	Cache.PersistentFlags().StringVar(&cacheDir, "cache-dir", os.Getenv("IMAGE_BUILDER_CACHE_DIR"), "Directory to cache downloaded images in, defaults to ~/.image-builder/cache")
+	Cache.AddCommand(&cacheList, &cachePrune, &cacheExport, &cacheImport)
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/image-builder/pkg/history"
+)
+
+var stateDir string
+
+var History = cobra.Command{
+	Use:   "history",
+	Short: "List previous builds",
+	Args:  cobra.MinimumNArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		records, err := history.List(history.Dir(stateDir))
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 3, 2, 3, ' ', 0)
+		fmt.Fprintf(w, "ID\tSTARTED\tDURATION\tDISTRO\tENGINE\tINPUT\tOUTPUT\tSTATUS\n")
+		for _, record := range records {
+			input := ""
+			if record.Input != nil {
+				input = record.Input.Kind
+			}
+			var outputs []string
+			for _, output := range record.Outputs {
+				outputs = append(outputs, output.Image.Image)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.ID, record.Started.Format(time.RFC3339),
+				record.Duration.Round(time.Second), record.Distro, record.Engine, input, strings.Join(outputs, ","), record.Status)
+		}
+		return w.Flush()
+	},
+}
+
+var Show = cobra.Command{
+	Use:   "show [id]",
+	Short: "Show the record of a build, defaults to the most recent build",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := history.Dir(stateDir)
+		var record *history.Record
+		if len(args) > 0 {
+			var err error
+			if record, err = history.Get(dir, args[0]); err != nil {
+				return err
+			}
+		} else {
+			records, err := history.List(dir)
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				return fmt.Errorf("no builds found in %s", dir)
+			}
+			record = &records[0]
+		}
+		return record.Encode(os.Stdout)
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{&Build, &History, &Show} {
+		cmd.Flags().StringVar(&stateDir, "state-dir", os.Getenv("IMAGE_BUILDER_STATE_DIR"), "Directory to store build records in, defaults to ~/.image-builder")
+	}
+}
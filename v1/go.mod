@@ -13,6 +13,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
 	gopkg.in/flanksource/yaml.v3 v3.1.0
 	gopkg.in/yaml.v2 v2.2.8
 )
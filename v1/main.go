@@ -50,7 +50,7 @@ func main() {
 		},
 	}
 
-	root.AddCommand(&cmd.Build, &cmd.Images)
+	root.AddCommand(&cmd.Build, &cmd.Images, &cmd.History, &cmd.Show, &cmd.Cache)
 
 	root.AddCommand(&cobra.Command{
 		Use:   "version",
@@ -0,0 +1,165 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cache
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Export writes the entries and their metadata to w as a tar archive that can be imported on another machine
+func (c Cache) Export(w io.Writer, entries []Entry) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		digest := strings.TrimPrefix(entry.Digest, "sha256:")
+		if err := addFile(tw, entry.Path, "sha256/"+digest); err != nil {
+			return err
+		}
+		// the metadata follows the image so that import can verify the image first
+		if err := addFile(tw, entry.Path+".json", "sha256/"+digest+".json"); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addFile(tw *tar.Writer, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Import adds the images in a tar archive created by Export, optionally gzip compressed, to the cache.
+// Each image is verified against the digest it is named after.
+func (c Cache) Import(r io.Reader) ([]Entry, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	if err := os.MkdirAll(filepath.Join(c.Dir, "partial"), 0755); err != nil {
+		return nil, err
+	}
+
+	var imported []Entry
+	metadata := make(map[string]Entry)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Dir(header.Name) != "sha256" {
+			continue
+		}
+		name := path.Base(header.Name)
+		if strings.HasSuffix(name, ".json") {
+			entry := Entry{}
+			if err := json.NewDecoder(tr).Decode(&entry); err != nil {
+				return nil, fmt.Errorf("invalid cache entry %s: %v", header.Name, err)
+			}
+			metadata[strings.TrimSuffix(name, ".json")] = entry
+			continue
+		}
+
+		tmp, err := ioutil.TempFile(filepath.Join(c.Dir, "partial"), "import-")
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(tmp, tr)
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+		entry, err := c.Add(tmp.Name(), Checksum{Algorithm: "sha256", Hex: name}, Entry{})
+		if err != nil {
+			os.Remove(tmp.Name())
+			return nil, fmt.Errorf("failed to import %s: %v", header.Name, err)
+		}
+		imported = append(imported, *entry)
+	}
+
+	// restore the source URL and validators so that the images are found when building
+	for i, entry := range imported {
+		meta, ok := metadata[strings.TrimPrefix(entry.Digest, "sha256:")]
+		if !ok {
+			continue
+		}
+		entry.URL = meta.URL
+		entry.ETag = meta.ETag
+		entry.LastModified = meta.LastModified
+		entry.ChecksumFile = meta.ChecksumFile
+		for algorithm, hex := range meta.Digests {
+			if _, ok := algorithms[algorithm]; !ok {
+				continue
+			}
+			// other digests are only trusted once verified, as they are used to find images by checksum
+			digests, err := digest(entry.Path, algorithm)
+			if err != nil {
+				return nil, err
+			}
+			if digests[algorithm] == hex {
+				entry.Digests[algorithm] = hex
+			}
+		}
+		if !meta.Added.IsZero() {
+			entry.Added = meta.Added
+		}
+		entry.LastUsed = time.Now()
+		if err := c.Save(entry); err != nil {
+			return nil, err
+		}
+		imported[i] = entry
+	}
+	return imported, nil
+}
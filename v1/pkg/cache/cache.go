@@ -0,0 +1,496 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package cache downloads images into a local cache that is keyed by the sha256 digest of their
+// contents, so that an upstream image that changes without changing its name is never reused.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+)
+
+// Entry describes a cached image, it is stored alongside the image as <digest>.json
+type Entry struct {
+	// Digest is the sha256 digest of the image
+	Digest string `json:"digest"`
+	URL    string `json:"url,omitempty"`
+	Size   int64  `json:"size"`
+	// Digests contains any other digests the image was verified with, keyed by algorithm
+	Digests      map[string]string `json:"digests,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified string            `json:"last_modified,omitempty"`
+	// ChecksumFile is the checksum file the image was verified with, so that it can be found without network access
+	ChecksumFile string    `json:"checksum_file,omitempty"`
+	Added        time.Time `json:"added"`
+	LastUsed     time.Time `json:"last_used"`
+	// Path is the location of the cached image
+	Path string `json:"-"`
+}
+
+type Cache struct {
+	Dir string
+	// LegacyDir is where previous versions cached images by the base name of their URL, images found there are
+	// moved into the cache instead of being downloaded again
+	LegacyDir string
+}
+
+// DefaultDir returns $IMAGE_BUILDER_CACHE_DIR or ~/.image-builder/cache
+func DefaultDir() string {
+	if dir := os.Getenv("IMAGE_BUILDER_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return path.Join(home, ".image-builder", "cache")
+}
+
+// New returns a cache stored in dir, or the default directory if dir is empty. Images cached in ~/.konfigadm/images
+// by previous versions are only used by the default cache.
+func New(dir string) Cache {
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		return Cache{Dir: DefaultDir(), LegacyDir: path.Join(home, ".konfigadm", "images")}
+	}
+	return Cache{Dir: dir}
+}
+
+func (c Cache) blobs() string {
+	return filepath.Join(c.Dir, "sha256")
+}
+
+// Entries returns every image in the cache, most recently used first
+func (c Cache) Entries() ([]Entry, error) {
+	files, err := ioutil.ReadDir(c.blobs())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		entry, err := c.Get(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.After(entries[j].LastUsed) })
+	return entries, nil
+}
+
+// Get returns the entry for a sha256 digest, with or without the sha256: prefix
+func (c Cache) Get(digest string) (*Entry, error) {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	data, err := ioutil.ReadFile(filepath.Join(c.blobs(), digest+".json"))
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("invalid cache entry %s: %v", digest, err)
+	}
+	entry.Path = filepath.Join(c.blobs(), digest)
+	return entry, nil
+}
+
+// Find returns the cached entry matching checksum, or nil if there is none
+func (c Cache) Find(checksum Checksum) (*Entry, error) {
+	if checksum.IsEmpty() {
+		return nil, nil
+	}
+	if checksum.Algorithm == "sha256" {
+		entry, err := c.Get(checksum.Hex)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return entry, err
+	}
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Digests[checksum.Algorithm] == checksum.Hex {
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// Save writes the metadata of an entry
+func (c Cache) Save(entry Entry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.blobs(), strings.TrimPrefix(entry.Digest, "sha256:")+".json"), data, 0644)
+}
+
+// Remove deletes an image and its metadata from the cache
+func (c Cache) Remove(entry Entry) error {
+	digest := strings.TrimPrefix(entry.Digest, "sha256:")
+	if err := os.Remove(filepath.Join(c.blobs(), digest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(filepath.Join(c.blobs(), digest+".json"))
+}
+
+// Add moves file into the cache, verifying it against checksum if one is specified
+func (c Cache) Add(file string, checksum Checksum, entry Entry) (*Entry, error) {
+	digests, err := digest(file, checksum.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !checksum.IsEmpty() && digests[checksum.Algorithm] != checksum.Hex {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s:%s", entry.URL, checksum, checksum.Algorithm, digests[checksum.Algorithm])
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(c.blobs(), 0755); err != nil {
+		return nil, err
+	}
+	entry.Digest = "sha256:" + digests["sha256"]
+	entry.Size = info.Size()
+	entry.Digests = make(map[string]string)
+	for algorithm, hex := range digests {
+		if algorithm != "sha256" {
+			entry.Digests[algorithm] = hex
+		}
+	}
+	entry.Added = time.Now()
+	entry.LastUsed = entry.Added
+	entry.Path = filepath.Join(c.blobs(), digests["sha256"])
+	if err := os.Rename(file, entry.Path); err != nil {
+		return nil, err
+	}
+	if err := c.Save(entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ResolveChecksum resolves checksum like ParseChecksum, if a checksum file cannot be downloaded due to a network
+// error the digest of the image previously verified with it is used instead
+func (c Cache) ResolveChecksum(url, checksum, checksumType string) (Checksum, error) {
+	resolved, err := ParseChecksum(url, checksum, checksumType)
+	if err == nil || !isNetworkError(err) || !strings.HasPrefix(strings.TrimSpace(checksum), "file:") {
+		return resolved, err
+	}
+	file := strings.TrimPrefix(strings.TrimSpace(checksum), "file:")
+	entries, lerr := c.Entries()
+	if lerr != nil {
+		return Checksum{}, err
+	}
+	for _, entry := range entries {
+		if entry.URL == url && entry.ChecksumFile == file {
+			logger.Warnf("%v, using the cached image that was verified with it", err)
+			return Checksum{Algorithm: "sha256", Hex: strings.TrimPrefix(entry.Digest, "sha256:"), File: file}, nil
+		}
+	}
+	return Checksum{}, err
+}
+
+// Fetch returns the path to a cached copy of url, downloading it if it is not cached. Without a checksum the
+// most recent download of url is only reused if the server reports it has not changed.
+func (c Cache) Fetch(url string, checksum Checksum) (string, error) {
+	entry, err := c.Find(checksum)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil && checksum.IsEmpty() {
+		logger.Warnf("No checksum specified for %s, its integrity cannot be verified", url)
+		if entry, err = c.revalidate(url); err != nil {
+			return "", err
+		}
+	}
+	if entry == nil {
+		entry = c.migrate(url, checksum)
+	}
+	if entry != nil {
+		logger.Infof("Image found in cache: %s (%s)", path.Base(url), entry.Digest)
+		entry.LastUsed = time.Now()
+		if checksum.File != "" {
+			entry.ChecksumFile = checksum.File
+		}
+		return entry.Path, c.Save(*entry)
+	}
+
+	partial := filepath.Join(c.Dir, "partial", fmt.Sprintf("%x", sha256.Sum256([]byte(url))))
+	validators, err := download(url, partial, !checksum.IsEmpty())
+	if err != nil {
+		return "", err
+	}
+	entry, err = c.Add(partial, checksum, Entry{
+		URL:          url,
+		ETag:         validators.ETag,
+		LastModified: validators.LastModified,
+		ChecksumFile: checksum.File,
+	})
+	if err != nil {
+		// a corrupt partial download cannot be resumed, so start again next time
+		os.Remove(partial)
+		os.Remove(partial + ".json")
+		return "", err
+	}
+	os.Remove(partial + ".json")
+	logger.Infof("Downloaded %s (%s)", url, entry.Digest)
+	return entry.Path, nil
+}
+
+// migrate moves an image cached by a previous version into the cache once it has been verified against checksum.
+// Previous versions cached images by the base name of their URL only, so without a checksum there is no way to
+// tell whether the image is the one at url, and it is downloaded again instead.
+func (c Cache) migrate(url string, checksum Checksum) *Entry {
+	if c.LegacyDir == "" || checksum.IsEmpty() {
+		return nil
+	}
+	file := filepath.Join(c.LegacyDir, path.Base(url))
+	if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	logger.Infof("Moving %s from %s into the cache", path.Base(url), c.LegacyDir)
+	entry, err := c.Add(file, checksum, Entry{URL: url})
+	if err != nil {
+		logger.Warnf("Not using %s: %v", file, err)
+		return nil
+	}
+	return entry
+}
+
+// revalidate returns the most recent download of url if the server reports that it has not changed
+func (c Cache) revalidate(url string) (*Entry, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.URL != url {
+			continue
+		}
+		if entry.ETag == "" && entry.LastModified == "" {
+			return nil, nil
+		}
+		req, err := http.NewRequest(http.MethodHead, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil && isNetworkError(err) {
+			logger.Warnf("Failed to check if %s has changed, using the cached image: %v", url, err)
+			return &entry, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %v", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil
+		}
+		if entry.ETag != "" && resp.Header.Get("ETag") == entry.ETag {
+			return &entry, nil
+		}
+		if entry.ETag == "" && resp.Header.Get("Last-Modified") == entry.LastModified {
+			return &entry, nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// download downloads url to dst, resuming a previous partial download if the server supports range requests.
+// Without validators to check that the file has not changed since, a partial download is only resumed if the
+// result is verified against a checksum.
+func download(url, dst string, verified bool) (*validators, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+	previous := &validators{}
+	if data, err := ioutil.ReadFile(dst + ".json"); err == nil {
+		json.Unmarshal(data, previous) // nolint: errcheck
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && !verified && previous.ETag == "" && previous.LastModified == "" {
+		logger.Infof("Restarting download of %s, it cannot be resumed without a checksum", url)
+		offset = 0
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// only resume if the file has not changed since the partial download
+		if previous.ETag != "" {
+			req.Header.Set("If-Range", previous.ETag)
+		} else if previous.LastModified != "" {
+			req.Header.Set("If-Range", previous.LastModified)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	current := &validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		logger.Infof("Resuming download of %s from %d bytes", url, offset)
+		if current.ETag == "" && current.LastModified == "" {
+			current = previous
+		}
+		return current, copyWithProgress(f, resp.Body, url, offset, offset+resp.ContentLength)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial download is already complete
+		return previous, nil
+	case http.StatusOK:
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if data, err := json.Marshal(current); err == nil {
+			ioutil.WriteFile(dst+".json", data, 0644) // nolint: errcheck
+		}
+		logger.Infof("Downloading %s", url)
+		return current, copyWithProgress(f, resp.Body, url, 0, resp.ContentLength)
+	}
+	return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+}
+
+// copyWithProgress copies src to dst, logging progress every 10%
+func copyWithProgress(dst io.Writer, src io.Reader, url string, offset, total int64) error {
+	buf := make([]byte, 1024*1024)
+	written := offset
+	next := int64(10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			written += int64(n)
+			if total > 0 && written*100/total >= next {
+				logger.Infof("Downloaded %d%% of %s", written*100/total, path.Base(url))
+				next = written*100/total/10*10 + 10
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("download of %s interrupted after %d bytes, it will be resumed on the next run: %v", url, written, err)
+		}
+	}
+}
+
+// Prune removes images that have not been used within maxAge, and then the least recently used images until
+// the cache is no larger than maxSize, a zero maxAge or maxSize disables that limit. The removed entries are returned.
+func (c Cache) Prune(maxAge time.Duration, maxSize int64, dryRun bool) ([]Entry, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	var removed []Entry
+	// entries are sorted most recently used first, so evict from the end
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		expired := maxAge > 0 && time.Since(entry.LastUsed) > maxAge
+		if !expired && (maxSize <= 0 || total <= maxSize) {
+			continue
+		}
+		if !dryRun {
+			if err := c.Remove(entry); err != nil {
+				return removed, err
+			}
+		}
+		total -= entry.Size
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// FormatSize formats a size in bytes using binary units, e.g. 1.5GB
+func FormatSize(size int64) string {
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(sizeUnits)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", value, sizeUnits[unit])
+}
+
+// ParseSize parses a size such as 20GB, 512M or 1024 into bytes using binary units
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	for i := len(sizeUnits) - 1; i > 0; i-- {
+		if strings.HasSuffix(s, sizeUnits[i][:1]) {
+			s = strings.TrimSuffix(s, sizeUnits[i][:1])
+			multiplier = 1 << (10 * uint(i))
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,151 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFetchOffline checks that cached images are used when the server cannot be reached
+func TestFetchOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-builder-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the address of a closed server refuses connections
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	url := server.URL + "/disk.img"
+	sums := server.URL + "/SHA256SUMS"
+
+	c := New(path.Join(dir, "cache"))
+	file := path.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := c.Add(file, Checksum{Algorithm: "sha256", Hex: sha256Hex}, Entry{URL: url, ChecksumFile: sums, ETag: `"1"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := c.ResolveChecksum(url, "file:"+sums, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum.Hex != sha256Hex {
+		t.Errorf("expected the digest of the cached image, got %v", checksum)
+	}
+	if _, err := c.ResolveChecksum(server.URL+"/other.img", "file:"+sums, ""); err == nil {
+		t.Errorf("expected an error for an image that is not cached")
+	}
+
+	for _, checksum := range []Checksum{checksum, {}} {
+		cached, err := c.Fetch(url, checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != entry.Path {
+			t.Errorf("expected %s, got %s", entry.Path, cached)
+		}
+	}
+}
+
+// TestDownloadRestart checks that a partial download without validators is only resumed if it is verified
+func TestDownloadRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-builder-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents := "the upstream image has changed"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// a zero modification time omits the Last-Modified header
+		http.ServeContent(w, req, "disk.img", time.Time{}, strings.NewReader(contents))
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		verified bool
+		expected string
+	}{
+		{verified: false, expected: contents},
+		{verified: true, expected: "the partial download" + contents[len("the partial download"):]},
+	} {
+		partial := path.Join(dir, "partial")
+		if err := ioutil.WriteFile(partial, []byte("the partial download"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := download(server.URL+"/disk.img", partial, test.verified); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("verified=%v: expected %q, got %q", test.verified, test.expected, data)
+		}
+	}
+}
+
+// TestMigrate checks that images cached by previous versions are moved into the cache
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-builder-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := Cache{Dir: path.Join(dir, "cache"), LegacyDir: path.Join(dir, "images")}
+	if err := os.MkdirAll(c.LegacyDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := path.Join(c.LegacyDir, "disk.img")
+	if err := ioutil.WriteFile(legacy, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the server is closed, so the image can only be found in the previous cache
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	if _, err := c.Fetch(server.URL+"/disk.img", Checksum{}); err == nil {
+		t.Fatal("expected an image without a checksum not to be used")
+	}
+	if _, err := c.Fetch(server.URL+"/disk.img", Checksum{Algorithm: "md5", Hex: "00000000000000000000000000000000"}); err == nil {
+		t.Fatal("expected an image with a different checksum not to be used")
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Fatalf("expected %s to be left in place: %v", legacy, err)
+	}
+	cached, err := c.Fetch(server.URL+"/disk.img", Checksum{Algorithm: "sha256", Hex: sha256Hex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != path.Join(c.Dir, "sha256", sha256Hex) {
+		t.Errorf("unexpected path %s", cached)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be moved", legacy)
+	}
+}
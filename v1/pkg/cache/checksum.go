@@ -0,0 +1,183 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cache
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Checksum is an expected digest of a download
+type Checksum struct {
+	// Algorithm is one of md5, sha1, sha256 or sha512
+	Algorithm string
+	Hex       string
+	// File is the location of the checksum file the digest was found in, if any
+	File string
+}
+
+func (c Checksum) String() string {
+	return c.Algorithm + ":" + c.Hex
+}
+
+func (c Checksum) IsEmpty() bool {
+	return c.Hex == ""
+}
+
+var algorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// bsdSum matches checksum lines in the BSD format, e.g. SHA256 (file.img) = abc
+var bsdSum = regexp.MustCompile(`^([A-Za-z0-9]+) \((.+)\) = ([a-fA-F0-9]+)$`)
+
+// ParseChecksum resolves the expected checksum for url. checksum is either a hex digest, a digest
+// prefixed with its algorithm e.g. sha256:abc, or file: followed by the URL or path of a checksum file
+// such as SHA256SUMS. The algorithm is inferred from the length of the digest when checksumType is empty.
+func ParseChecksum(url, checksum, checksumType string) (Checksum, error) {
+	checksum = strings.TrimSpace(checksum)
+	checksumType = strings.ToLower(checksumType)
+	if checksum == "" || checksumType == "none" {
+		return Checksum{}, nil
+	}
+	file := ""
+	if strings.HasPrefix(checksum, "file:") {
+		file = strings.TrimPrefix(checksum, "file:")
+		sum, err := lookupChecksumFile(file, path.Base(url))
+		if err != nil {
+			return Checksum{}, err
+		}
+		checksum = sum
+	}
+	// BSD style checksum files resolve to a digest prefixed with its algorithm
+	if i := strings.Index(checksum, ":"); i > 0 {
+		checksumType = strings.ToLower(checksum[:i])
+		checksum = checksum[i+1:]
+	}
+	if checksumType == "" {
+		checksumType = inferAlgorithm(checksum)
+	}
+	if _, ok := algorithms[checksumType]; !ok {
+		return Checksum{}, fmt.Errorf("unsupported checksum type %s for %s", checksumType, url)
+	}
+	if len(checksum) != algorithms[checksumType]().Size()*2 {
+		return Checksum{}, fmt.Errorf("invalid %s checksum for %s: %s", checksumType, url, checksum)
+	}
+	return Checksum{Algorithm: checksumType, Hex: strings.ToLower(checksum), File: file}, nil
+}
+
+func inferAlgorithm(hex string) string {
+	for name, fn := range algorithms {
+		if fn().Size()*2 == len(hex) {
+			return name
+		}
+	}
+	return ""
+}
+
+// lookupChecksumFile finds the digest of name in a GNU or BSD style checksum file
+func lookupChecksumFile(location, name string) (string, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := http.Get(location)
+		if err != nil {
+			return "", fmt.Errorf("failed to download checksum file %s: %w", location, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("failed to download checksum file %s: %s", location, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(strings.TrimPrefix(location, "//"))
+		if err != nil {
+			return "", err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := bsdSum.FindStringSubmatch(line); match != nil {
+			if path.Base(match[2]) == name {
+				return strings.ToLower(match[1]) + ":" + match[3], nil
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// binary mode entries are prefixed with *
+		if path.Base(strings.TrimPrefix(fields[1], "*")) == name {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s not found in checksum file %s", name, location)
+}
+
+// isNetworkError returns true if err was caused by the network, e.g. when there is no network access
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// digest returns the sha256 digest of the file, as well as the digest using algorithm if it is not sha256
+func digest(file string, algorithm string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes := map[string]hash.Hash{"sha256": sha256.New()}
+	if algorithm != "" {
+		hashes[algorithm] = algorithms[algorithm]()
+	}
+	var writers []io.Writer
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for name, h := range hashes {
+		digests[name] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return digests, nil
+}
@@ -0,0 +1,98 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const (
+	md5Hex    = "d41d8cd98f00b204e9800998ecf8427e"
+	sha1Hex   = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	sha256Hex = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestParseChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-builder-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sumFiles := map[string]string{
+		"gnu": "0000000000000000000000000000000000000000000000000000000000000000  other.img\n" +
+			sha256Hex + "  disk.img\n",
+		"binary": sha256Hex + " *disk.img\n",
+		"bsd": "# Fedora-Cloud-Base.x86_64.qcow2: 1234 bytes\n" +
+			"SHA256 (other.img) = 0000000000000000000000000000000000000000000000000000000000000000\n" +
+			"SHA256 (disk.img) = " + strings.ToUpper(sha256Hex) + "\n",
+		"bsd-md5": "MD5 (disk.img) = " + md5Hex + "\n",
+		"missing": sha256Hex + "  other.img\n",
+	}
+	for name, contents := range sumFiles {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		checksum     string
+		checksumType string
+		expected     Checksum
+		err          bool
+	}{
+		{name: "empty", checksum: ""},
+		{name: "none", checksum: sha256Hex, checksumType: "none"},
+		{name: "inferred sha256", checksum: sha256Hex, expected: Checksum{Algorithm: "sha256", Hex: sha256Hex}},
+		{name: "inferred sha1", checksum: sha1Hex, expected: Checksum{Algorithm: "sha1", Hex: sha1Hex}},
+		{name: "inferred md5", checksum: md5Hex, expected: Checksum{Algorithm: "md5", Hex: md5Hex}},
+		{name: "explicit type", checksum: strings.ToUpper(sha256Hex), checksumType: "SHA256", expected: Checksum{Algorithm: "sha256", Hex: sha256Hex}},
+		{name: "prefixed", checksum: "sha256:" + sha256Hex, expected: Checksum{Algorithm: "sha256", Hex: sha256Hex}},
+		{name: "prefixed uppercase", checksum: "SHA1:" + sha1Hex, expected: Checksum{Algorithm: "sha1", Hex: sha1Hex}},
+		{name: "wrong length", checksum: "sha256:" + sha1Hex, err: true},
+		{name: "unknown length", checksum: "abc", err: true},
+		{name: "unsupported type", checksum: "crc32:" + md5Hex, err: true},
+		{name: "gnu file", checksum: "file:" + path.Join(dir, "gnu"), expected: Checksum{Algorithm: "sha256", Hex: sha256Hex, File: path.Join(dir, "gnu")}},
+		{name: "binary mode file", checksum: "file:" + path.Join(dir, "binary"), expected: Checksum{Algorithm: "sha256", Hex: sha256Hex, File: path.Join(dir, "binary")}},
+		{name: "bsd file", checksum: "file:" + path.Join(dir, "bsd"), expected: Checksum{Algorithm: "sha256", Hex: sha256Hex, File: path.Join(dir, "bsd")}},
+		{name: "bsd md5 file", checksum: "file:" + path.Join(dir, "bsd-md5"), expected: Checksum{Algorithm: "md5", Hex: md5Hex, File: path.Join(dir, "bsd-md5")}},
+		{name: "file with type", checksum: "file:" + path.Join(dir, "gnu"), checksumType: "sha256", expected: Checksum{Algorithm: "sha256", Hex: sha256Hex, File: path.Join(dir, "gnu")}},
+		{name: "not in file", checksum: "file:" + path.Join(dir, "missing"), err: true},
+		{name: "missing file", checksum: "file:" + path.Join(dir, "nonexistent"), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checksum, err := ParseChecksum("https://example.com/images/disk.img", test.checksum, test.checksumType)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", checksum)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checksum != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, checksum)
+			}
+		})
+	}
+}
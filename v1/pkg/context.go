@@ -36,12 +36,24 @@ type BuildContext struct {
 	Defaults  map[string]map[string]interface{}
 	DryRun    bool
 	Raw       map[string]interface{}
+	Steps     []api.Executable
 }
 
 func (ctx BuildContext) String() string {
 	return fmt.Sprintf("input=%s  output=%s engine=%s distro=%s", ctx.Input, ctx.Output, ctx.Engine, ctx.Distro)
 }
 
+// Execute translates each provisioning step into the native form of engine, steps may update ctx.Input
+func (ctx *BuildContext) Execute(engine api.Executor) error {
+	for _, step := range ctx.Steps {
+		ctx.Debugf("Adding %s step", step.Kind())
+		if err := step.Execute(&ctx.Input, engine); err != nil {
+			return fmt.Errorf("failed to add %s step: %v", step.Kind(), err)
+		}
+	}
+	return nil
+}
+
 func (ctx BuildContext) GetBinary(name string) deps.BinaryFunc {
 	if ctx.DryRun {
 		return func(msg string, args ...interface{}) error {
@@ -2,27 +2,128 @@ package converters
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/flanksource/commons/logger"
 	"sigs.k8s.io/image-builder/api"
 	"sigs.k8s.io/image-builder/pkg"
 )
 
-type Converter func(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error)
+type ConvertFunc func(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error)
 
-var Converters = map[string]Converter{
-	"vmdk->ova":  VmdkToOVA,
-	"ova->vm":    OVAToVM,
-	"qcow->vmdk": DiskImageToVMDK,
-	"disk->vmdk": DiskImageToVMDK,
-	"img->vmdk":  DiskImageToVMDK,
+// Converter is an edge in the conversion graph, transforming an image of
+// kind From into an image of kind To
+type Converter struct {
+	From    string
+	To      string
+	Convert ConvertFunc
 }
 
-func Convert(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
-	name := fmt.Sprintf("%s->%s", from.Kind(), to.Kind())
+func (c Converter) String() string {
+	return fmt.Sprintf("%s->%s", c.From, c.To)
+}
+
+// Path is an ordered chain of converters, where the To of each converter is the From of the next
+type Path []Converter
+
+func (p Path) String() string {
+	if len(p) == 0 {
+		return ""
+	}
+	kinds := []string{p[0].From}
+	for _, converter := range p {
+		kinds = append(kinds, converter.To)
+	}
+	return strings.Join(kinds, " -> ")
+}
+
+var Converters = []Converter{
+	{From: api.VMDKKind, To: api.OVAKind, Convert: VmdkToOVA},
+	{From: api.OVAKind, To: api.VMKind, Convert: OVAToVM},
+	{From: api.DiskImageKind, To: api.VMDKKind, Convert: DiskImageToVMDK},
+	{From: api.DiskImageKind, To: api.RawImageKind, Convert: DiskImageToRaw},
+	{From: api.DiskImageKind, To: api.VHDKind, Convert: DiskImageToVHD},
+	{From: api.DiskImageKind, To: api.VHDXKind, Convert: DiskImageToVHDX},
+	{From: api.RawImageKind, To: api.DiskImageKind, Convert: RawToDiskImage},
+	{From: api.RawImageKind, To: api.VMDKKind, Convert: DiskImageToVMDK},
+	{From: api.RawImageKind, To: api.VHDKind, Convert: DiskImageToVHD},
+	{From: api.RawImageKind, To: api.VHDXKind, Convert: DiskImageToVHDX},
+	{From: api.DockerImageKind, To: api.OCIKind, Convert: DockerToOCI},
+	{From: api.OCIKind, To: api.RegistryKind, Convert: OCIToRegistry},
+	{From: api.OCIKind, To: api.DiskImageKind, Convert: OCIToDiskImage},
+	{From: api.RootFSKind, To: api.DiskImageKind, Convert: RootFSToDiskImage},
+}
 
-	converter, ok := Converters[name]
-	if !ok {
-		return nil, fmt.Errorf("no converter found for %s", name)
+// FindPath returns the shortest chain of converters from one image kind to another
+func FindPath(from, to string) (Path, error) {
+	if from == to {
+		return Path{}, nil
+	}
+	// breadth first search, so that the first path found is the shortest
+	visited := map[string]Path{from: {}}
+	queue := []string{from}
+	for len(queue) > 0 {
+		kind := queue[0]
+		queue = queue[1:]
+		for _, converter := range Converters {
+			if converter.From != kind {
+				continue
+			}
+			if _, ok := visited[converter.To]; ok {
+				continue
+			}
+			path := append(append(Path{}, visited[kind]...), converter)
+			if converter.To == to {
+				return path, nil
+			}
+			visited[converter.To] = path
+			queue = append(queue, converter.To)
+		}
+	}
+	return nil, fmt.Errorf("no converter found for %s->%s, reachable targets from %s are: [%s]", from, to, from, strings.Join(Reachable(from), ", "))
+}
+
+// Reachable returns all the image kinds that an image of kind from can be converted to
+func Reachable(from string) []string {
+	visited := map[string]bool{from: true}
+	queue := []string{from}
+	var reachable []string
+	for len(queue) > 0 {
+		kind := queue[0]
+		queue = queue[1:]
+		for _, converter := range Converters {
+			if converter.From != kind || visited[converter.To] {
+				continue
+			}
+			visited[converter.To] = true
+			reachable = append(reachable, converter.To)
+			queue = append(queue, converter.To)
+		}
+	}
+	sort.Strings(reachable)
+	return reachable
+}
+
+// Convert finds the shortest chain of converters from -> to and runs each of them in turn,
+// intermediate images are created with default options.
+func Convert(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	path, err := FindPath(from.Kind(), to.Kind())
+	if err != nil {
+		return nil, err
+	}
+	image := from
+	for i, converter := range path {
+		target := to
+		if i < len(path)-1 {
+			if target, err = api.GetImage(map[string]interface{}{"kind": converter.To}); err != nil {
+				return nil, err
+			}
+		}
+		logger.Infof("Converting %s (%s)", converter, image)
+		if image, err = converter.Convert(ctx, image, target); err != nil {
+			return nil, fmt.Errorf("failed to convert %s: %v", converter, err)
+		}
 	}
-	return converter(ctx, from, to)
+	return image, nil
 }
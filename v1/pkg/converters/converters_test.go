@@ -0,0 +1,76 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package converters
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/image-builder/api"
+)
+
+func TestFindPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		expected string
+		err      bool
+	}{
+		{name: "same kind", from: api.DiskImageKind, to: api.DiskImageKind, expected: ""},
+		{name: "direct", from: api.DiskImageKind, to: api.VMDKKind, expected: "img -> vmdk"},
+		{name: "multi hop", from: api.DockerImageKind, to: api.DiskImageKind, expected: "docker -> oci -> img"},
+		{name: "shortest", from: api.DiskImageKind, to: api.VMKind, expected: "img -> vmdk -> ova -> vm"},
+		{name: "unreachable", from: api.VMKind, to: api.DiskImageKind, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := FindPath(test.from, test.to)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path.String() != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, path)
+			}
+		})
+	}
+}
+
+func TestReachable(t *testing.T) {
+	tests := []struct {
+		from     string
+		expected []string
+	}{
+		{from: api.VMKind},
+		{from: api.OVAKind, expected: []string{api.VMKind}},
+		{from: api.DockerImageKind, expected: []string{api.DiskImageKind, api.OCIKind, api.OVAKind, api.RawImageKind,
+			api.RegistryKind, api.VHDKind, api.VHDXKind, api.VMKind, api.VMDKKind}},
+	}
+	for _, test := range tests {
+		t.Run(test.from, func(t *testing.T) {
+			reachable := Reachable(test.from)
+			if strings.Join(reachable, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("expected %v, got %v", test.expected, reachable)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package converters
+
+import (
+	"path"
+
+	"github.com/flanksource/commons/files"
+	"github.com/flanksource/commons/logger"
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/converters/disk"
+)
+
+// diskURL returns the path for a new disk image alongside source with a different extension
+func diskURL(source, ext string) string {
+	return path.Join(path.Dir(source), files.GetBaseName(source)+"."+ext)
+}
+
+func convertDisk(from, to string, format disk.Format) error {
+	logger.Infof("Converting %s to %s (%s)", from, to, format)
+	return disk.Convert(from, to, format)
+}
+
+func DiskImageToVMDK(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	vmdk := to.(api.VMDK)
+	if vmdk.URL == "" {
+		vmdk.URL = diskURL(from.String(), "vmdk")
+	}
+	if err := convertDisk(from.String(), vmdk.URL, disk.VMDK); err != nil {
+		return nil, err
+	}
+	return vmdk, nil
+}
+
+func DiskImageToRaw(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	raw := to.(api.RawImage)
+	if raw.URL == "" {
+		raw.URL = diskURL(from.String(), "raw")
+	}
+	if err := convertDisk(from.String(), raw.URL, disk.Raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func DiskImageToVHD(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	vhd := to.(api.VHD)
+	if vhd.URL == "" {
+		vhd.URL = diskURL(from.String(), "vhd")
+	}
+	if err := convertDisk(from.String(), vhd.URL, disk.VHD); err != nil {
+		return nil, err
+	}
+	return vhd, nil
+}
+
+func DiskImageToVHDX(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	vhdx := to.(api.VHDX)
+	if vhdx.URL == "" {
+		vhdx.URL = diskURL(from.String(), "vhdx")
+	}
+	if err := convertDisk(from.String(), vhdx.URL, disk.VHDX); err != nil {
+		return nil, err
+	}
+	return vhdx, nil
+}
+
+// RawToDiskImage is a no-op, as raw images can be used anywhere a qcow2 image can
+func RawToDiskImage(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	img := to.(api.DiskImage)
+	img.URL = from.String()
+	return img, nil
+}
@@ -0,0 +1,187 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package disk reads and writes virtual disk formats without depending on
+// host tooling such as qemu-img.
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+type Format string
+
+const (
+	Raw   Format = "raw"
+	QCOW2 Format = "qcow2"
+	VMDK  Format = "vmdk"
+	VHD   Format = "vhd"
+	VHDX  Format = "vhdx"
+)
+
+const (
+	sectorSize = 512
+	mb         = 1024 * 1024
+)
+
+// Image is a virtual disk that can be read at any offset, regardless of the
+// format it is stored in on disk.
+type Image interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the virtual size of the disk in bytes
+	Size() int64
+}
+
+// sparseImage is implemented by images that can report unallocated regions
+// without reading (and decompressing) them.
+type sparseImage interface {
+	allocated(off, length int64) (bool, error)
+}
+
+// Detect returns the format of the disk image at path, anything unrecognised is treated as raw.
+func Detect(path string) (Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	switch {
+	case bytes.Equal(magic[:4], qcow2Magic):
+		return QCOW2, nil
+	case bytes.Equal(magic[:4], vmdkMagic):
+		return VMDK, nil
+	case bytes.Equal(magic, vhdxSignature):
+		return VHDX, nil
+	}
+	return Raw, nil
+}
+
+// Open opens a qcow2 or raw disk image for reading
+func Open(path string) (Image, error) {
+	format, err := Detect(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case QCOW2:
+		return openQcow2(path)
+	case Raw:
+		return openRaw(path)
+	}
+	return nil, fmt.Errorf("reading %s images is not supported: %s", format, path)
+}
+
+// VirtualSize returns the size of the disk as seen by a guest
+func VirtualSize(path string) (int64, error) {
+	format, err := Detect(path)
+	if err != nil {
+		return 0, err
+	}
+	switch format {
+	case VMDK:
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		header := vmdkHeader{}
+		if err := binary.Read(f, binary.LittleEndian, &header); err != nil {
+			return 0, fmt.Errorf("failed to read vmdk header %s: %v", path, err)
+		}
+		return int64(header.Capacity) * sectorSize, nil
+	case QCOW2, Raw:
+		img, err := Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer img.Close()
+		return img.Size(), nil
+	}
+	return 0, fmt.Errorf("cannot determine the size of %s images", format)
+}
+
+// Write writes the contents of src to a new image at path in the specified format
+func Write(src Image, path string, format Format) error {
+	switch format {
+	case Raw:
+		return writeRaw(src, path)
+	case VMDK:
+		return writeStreamOptimizedVMDK(src, path)
+	case VHD:
+		return writeFixedVHD(src, path)
+	case VHDX:
+		return writeVHDX(src, path)
+	}
+	return fmt.Errorf("writing %s images is not supported", format)
+}
+
+// Convert converts the qcow2 or raw image at from into a new image at to
+func Convert(from, to string, format Format) error {
+	src, err := Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := Write(src, to, format); err != nil {
+		os.Remove(to)
+		return fmt.Errorf("failed to write %s: %v", to, err)
+	}
+	return nil
+}
+
+// readChunk reads len(buf) bytes at off from src, zero-filling past the end of
+// the image, and returns false if the chunk contains only zeros.
+func readChunk(src Image, buf []byte, off int64) (bool, error) {
+	if s, ok := src.(sparseImage); ok {
+		allocated, err := s.allocated(off, int64(len(buf)))
+		if err != nil {
+			return false, err
+		}
+		if !allocated {
+			return false, nil
+		}
+	}
+	n, err := src.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return !isZero(buf), nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func roundUp(n, to int64) int64 {
+	return (n + to - 1) / to * to
+}
@@ -0,0 +1,321 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2Compressed     = 1 << 62
+	qcow2ZeroCluster    = 1
+	qcow2CorruptBit     = 1 << 1
+	qcow2ExternalData   = 1 << 2
+	qcow2CompressionBit = 1 << 3
+	qcow2ExtendedL2     = 1 << 4
+)
+
+// qcow2Header is the on-disk header common to version 2 and 3 images
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+// qcow2HeaderV3 contains the additional fields present in version 3 images
+type qcow2HeaderV3 struct {
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+type qcow2Image struct {
+	f           *os.File
+	header      qcow2Header
+	clusterSize int64
+	l2Entries   int64
+	l1          []uint64
+	backing     Image
+
+	mu      sync.Mutex
+	l2Cache map[uint64][]uint64
+	// the most recently decompressed cluster, compressed clusters are usually read sequentially
+	lastCompressed     uint64
+	lastCompressedData []byte
+}
+
+func openQcow2(name string) (Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := readQcow2(f, path.Dir(name))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("invalid qcow2 image %s: %v", name, err)
+	}
+	return img, nil
+}
+
+func readQcow2(f *os.File, dir string) (*qcow2Image, error) {
+	img := &qcow2Image{f: f, l2Cache: make(map[uint64][]uint64)}
+	if err := binary.Read(f, binary.BigEndian, &img.header); err != nil {
+		return nil, err
+	}
+	h := img.header
+	if h.Version < 2 || h.Version > 3 {
+		return nil, fmt.Errorf("unsupported version %d", h.Version)
+	}
+	if h.CryptMethod != 0 {
+		return nil, fmt.Errorf("encrypted images are not supported")
+	}
+	if h.ClusterBits < 9 || h.ClusterBits > 21 {
+		return nil, fmt.Errorf("invalid cluster bits %d", h.ClusterBits)
+	}
+	if h.Version == 3 {
+		v3 := qcow2HeaderV3{}
+		if err := binary.Read(f, binary.BigEndian, &v3); err != nil {
+			return nil, err
+		}
+		if v3.IncompatibleFeatures&qcow2CorruptBit != 0 {
+			return nil, fmt.Errorf("image is marked as corrupt")
+		}
+		if v3.IncompatibleFeatures&qcow2ExternalData != 0 {
+			return nil, fmt.Errorf("external data files are not supported")
+		}
+		if v3.IncompatibleFeatures&qcow2ExtendedL2 != 0 {
+			return nil, fmt.Errorf("extended L2 entries are not supported")
+		}
+		if v3.IncompatibleFeatures&qcow2CompressionBit != 0 && v3.HeaderLength > 104 {
+			compression := make([]byte, 1)
+			if _, err := f.ReadAt(compression, 104); err != nil {
+				return nil, err
+			}
+			if compression[0] != 0 {
+				return nil, fmt.Errorf("only zlib compression is supported")
+			}
+		}
+	}
+	img.clusterSize = 1 << h.ClusterBits
+	img.l2Entries = img.clusterSize / 8
+
+	img.l1 = make([]uint64, h.L1Size)
+	if _, err := f.Seek(int64(h.L1TableOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(f, binary.BigEndian, img.l1); err != nil {
+		return nil, fmt.Errorf("failed to read L1 table: %v", err)
+	}
+
+	if h.BackingFileOffset != 0 {
+		name := make([]byte, h.BackingFileSize)
+		if _, err := f.ReadAt(name, int64(h.BackingFileOffset)); err != nil {
+			return nil, fmt.Errorf("failed to read backing file name: %v", err)
+		}
+		backing := string(name)
+		if !path.IsAbs(backing) {
+			backing = path.Join(dir, backing)
+		}
+		var err error
+		if img.backing, err = Open(backing); err != nil {
+			return nil, fmt.Errorf("failed to open backing file: %v", err)
+		}
+	}
+	return img, nil
+}
+
+func (q *qcow2Image) Size() int64 {
+	return int64(q.header.Size)
+}
+
+func (q *qcow2Image) Close() error {
+	if q.backing != nil {
+		q.backing.Close()
+	}
+	return q.f.Close()
+}
+
+// lookup returns the L2 entry for a guest cluster, or 0 if it is unallocated
+func (q *qcow2Image) lookup(cluster int64) (uint64, error) {
+	l1Index := cluster / q.l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		return 0, nil
+	}
+	l2Offset := q.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	l2, ok := q.l2Cache[l2Offset]
+	if !ok {
+		l2 = make([]uint64, q.l2Entries)
+		data := make([]byte, q.clusterSize)
+		if _, err := q.f.ReadAt(data, int64(l2Offset)); err != nil {
+			return 0, fmt.Errorf("failed to read L2 table at %d: %v", l2Offset, err)
+		}
+		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, l2); err != nil {
+			return 0, err
+		}
+		q.l2Cache[l2Offset] = l2
+	}
+	return l2[cluster%q.l2Entries], nil
+}
+
+func (q *qcow2Image) isZero(entry uint64) bool {
+	return q.header.Version >= 3 && entry&qcow2Compressed == 0 && entry&qcow2ZeroCluster != 0
+}
+
+func (q *qcow2Image) allocated(off, length int64) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for cluster := off / q.clusterSize; cluster*q.clusterSize < off+length; cluster++ {
+		entry, err := q.lookup(cluster)
+		if err != nil {
+			return false, err
+		}
+		if q.isZero(entry) {
+			continue
+		}
+		if entry&qcow2Compressed != 0 || entry&qcow2OffsetMask != 0 {
+			return true, nil
+		}
+		if q.backing == nil || cluster*q.clusterSize >= q.backing.Size() {
+			continue
+		}
+		s, ok := q.backing.(sparseImage)
+		if !ok {
+			return true, nil
+		}
+		allocated, err := s.allocated(cluster*q.clusterSize, q.clusterSize)
+		if err != nil || allocated {
+			return allocated, err
+		}
+	}
+	return false, nil
+}
+
+func (q *qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= q.Size() {
+			return read, io.EOF
+		}
+		inCluster := pos % q.clusterSize
+		n := q.clusterSize - inCluster
+		if remaining := int64(len(p) - read); remaining < n {
+			n = remaining
+		}
+		if remaining := q.Size() - pos; remaining < n {
+			n = remaining
+		}
+		if err := q.readCluster(pos/q.clusterSize, inCluster, p[read:read+int(n)]); err != nil {
+			return read, err
+		}
+		read += int(n)
+	}
+	return read, nil
+}
+
+func (q *qcow2Image) readCluster(cluster, inCluster int64, p []byte) error {
+	entry, err := q.lookup(cluster)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry&qcow2Compressed != 0:
+		data, err := q.decompress(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inCluster:])
+		return nil
+	case q.isZero(entry):
+		zero(p)
+		return nil
+	case entry&qcow2OffsetMask != 0:
+		_, err := q.f.ReadAt(p, int64(entry&qcow2OffsetMask)+inCluster)
+		return err
+	}
+
+	// unallocated clusters are read from the backing file, or are zero
+	pos := cluster*q.clusterSize + inCluster
+	if q.backing == nil || pos >= q.backing.Size() {
+		zero(p)
+		return nil
+	}
+	n, err := q.backing.ReadAt(p, pos)
+	if err == io.EOF {
+		zero(p[n:])
+		return nil
+	}
+	return err
+}
+
+func (q *qcow2Image) decompress(entry uint64) ([]byte, error) {
+	if entry == q.lastCompressed && q.lastCompressedData != nil {
+		return q.lastCompressedData, nil
+	}
+	x := 62 - (q.header.ClusterBits - 8)
+	offset := entry & (1<<x - 1)
+	sectors := (entry >> x) & (1<<(62-x) - 1)
+	size := int64((sectors+1)*sectorSize - offset%sectorSize)
+
+	compressed := make([]byte, size)
+	n, err := q.f.ReadAt(compressed, int64(offset))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read compressed cluster at %d: %v", offset, err)
+	}
+	data := make([]byte, q.clusterSize)
+	r := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to decompress cluster at %d: %v", offset, err)
+	}
+	q.lastCompressed = entry
+	q.lastCompressedData = data
+	return data, nil
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
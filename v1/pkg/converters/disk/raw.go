@@ -0,0 +1,81 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package disk
+
+import (
+	"os"
+)
+
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func openRaw(path string) (Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rawImage{File: f, size: info.Size()}, nil
+}
+
+func (r *rawImage) Size() int64 {
+	return r.size
+}
+
+// writeSparse copies src into f starting at offset, skipping zero chunks so that
+// the destination stays sparse on filesystems that support it.
+func writeSparse(src Image, f *os.File, offset int64) error {
+	buf := make([]byte, mb)
+	for off := int64(0); off < src.Size(); off += int64(len(buf)) {
+		chunk := buf
+		if remaining := src.Size() - off; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		data, err := readChunk(src, chunk, off)
+		if err != nil {
+			return err
+		}
+		if !data {
+			continue
+		}
+		if _, err := f.WriteAt(chunk, offset+off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRaw(src Image, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(src.Size()); err != nil {
+		return err
+	}
+	if err := writeSparse(src, f, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
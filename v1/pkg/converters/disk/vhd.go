@@ -0,0 +1,144 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package disk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+const (
+	vhdFixed          = 2
+	vhdNoDataOffset   = 0xffffffffffffffff
+	vhdVersion        = 0x00010000
+	vhdFeatureDefault = 0x00000002
+)
+
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// vhdFooter is the hard disk footer from the Virtual Hard Disk Image Format Specification
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// vhdGeometry calculates the CHS geometry as described in appendix A of the VHD specification
+func vhdGeometry(size int64) (cylinders uint16, heads, sectorsPerTrack uint8) {
+	totalSectors := size / sectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+	var spt, h, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		h = 16
+		cylinderTimesHeads = totalSectors / spt
+	} else {
+		spt = 17
+		cylinderTimesHeads = totalSectors / spt
+		h = (cylinderTimesHeads + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cylinderTimesHeads >= h*1024 || h > 16 {
+			spt = 31
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+		if cylinderTimesHeads >= h*1024 {
+			spt = 63
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+	}
+	return uint16(cylinderTimesHeads / h), uint8(h), uint8(spt)
+}
+
+func newVHDFooter(size int64) ([]byte, error) {
+	footer := vhdFooter{
+		Features:          vhdFeatureDefault,
+		FileFormatVersion: vhdVersion,
+		DataOffset:        vhdNoDataOffset,
+		TimeStamp:         uint32(time.Since(vhdEpoch).Seconds()),
+		CreatorVersion:    vhdVersion,
+		CreatorHostOS:     0x5769326b, // Wi2k
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          vhdFixed,
+	}
+	copy(footer.Cookie[:], "conectix")
+	copy(footer.CreatorApplication[:], "imgb")
+	footer.Cylinders, footer.Heads, footer.SectorsPerTrack = vhdGeometry(size)
+	if _, err := rand.Read(footer.UniqueID[:]); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, footer); err != nil {
+		return nil, err
+	}
+	var checksum uint32
+	for _, b := range buf.Bytes() {
+		checksum += uint32(b)
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[64:68], ^checksum)
+	return data, nil
+}
+
+// writeFixedVHD writes a fixed VHD, with the virtual size rounded up to a whole MB as required by Azure
+func writeFixedVHD(src Image, path string) error {
+	size := roundUp(src.Size(), mb)
+	footer, err := newVHDFooter(size)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if err := writeSparse(src, f, 0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(footer, size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,290 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package disk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"unicode/utf16"
+
+	"sigs.k8s.io/image-builder/pkg/partitions"
+)
+
+var vhdxSignature = []byte("vhdxfile")
+
+const (
+	vhdxBlockSize          = 32 * mb
+	vhdxLogicalSectorSize  = 512
+	vhdxPhysicalSectorSize = 4096
+
+	vhdxHeader1Offset     = 64 * 1024
+	vhdxHeader2Offset     = 128 * 1024
+	vhdxRegion1Offset     = 192 * 1024
+	vhdxRegion2Offset     = 256 * 1024
+	vhdxLogOffset         = 1 * mb
+	vhdxLogLength         = 1 * mb
+	vhdxMetadataOffset    = 2 * mb
+	vhdxMetadataLength    = 1 * mb
+	vhdxBATOffset         = 3 * mb
+	vhdxMetadataItemStart = 64 * 1024
+
+	vhdxPayloadFullyPresent = 6
+
+	vhdxMetadataIsVirtualDisk = 1 << 1
+	vhdxMetadataIsRequired    = 1 << 2
+)
+
+var (
+	vhdxBATRegion              = guid("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion         = guid("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParametersItem     = guid("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSizeItem    = guid("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxVirtualDiskIDItem      = guid("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSizeItem  = guid("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSizeItem = guid("CDA348C7-445D-4471-9CC9-E9885251C556")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+	Reserved       [4016]byte
+}
+
+type vhdxRegionEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// guid encodes a well-known GUID, panicking if it is invalid
+func guid(s string) [16]byte {
+	g, err := partitions.ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func randomGUID() ([16]byte, error) {
+	var g [16]byte
+	_, err := rand.Read(g[:])
+	return g, err
+}
+
+// checksummed serializes v, pads it to size and stores the CRC-32C of the result at offset 4
+func checksummed(v interface{}, size int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	copy(data, buf.Bytes())
+	binary.LittleEndian.PutUint32(data[4:8], crc32.Checksum(data, crc32c))
+	return data, nil
+}
+
+func vhdxRegionTable(batLength uint32) ([]byte, error) {
+	table := struct {
+		Signature  [4]byte
+		Checksum   uint32
+		EntryCount uint32
+		Reserved   uint32
+		Entries    [2]vhdxRegionEntry
+	}{
+		EntryCount: 2,
+		Entries: [2]vhdxRegionEntry{
+			{GUID: vhdxBATRegion, FileOffset: vhdxBATOffset, Length: batLength, Required: 1},
+			{GUID: vhdxMetadataRegion, FileOffset: vhdxMetadataOffset, Length: vhdxMetadataLength, Required: 1},
+		},
+	}
+	copy(table.Signature[:], "regi")
+	return checksummed(table, 64*1024)
+}
+
+func vhdxMetadata(size int64) ([]byte, error) {
+	diskID, err := randomGUID()
+	if err != nil {
+		return nil, err
+	}
+	var items bytes.Buffer
+	var entries []vhdxMetadataEntry
+	add := func(id [16]byte, flags uint32, v interface{}) {
+		entries = append(entries, vhdxMetadataEntry{
+			ItemID: id,
+			Offset: uint32(vhdxMetadataItemStart + items.Len()),
+			Length: uint32(binary.Size(v)),
+			Flags:  flags | vhdxMetadataIsRequired,
+		})
+		binary.Write(&items, binary.LittleEndian, v)
+	}
+	add(vhdxFileParametersItem, 0, struct {
+		BlockSize uint32
+		Flags     uint32
+	}{BlockSize: vhdxBlockSize})
+	add(vhdxVirtualDiskSizeItem, vhdxMetadataIsVirtualDisk, uint64(size))
+	add(vhdxVirtualDiskIDItem, vhdxMetadataIsVirtualDisk, diskID)
+	add(vhdxLogicalSectorSizeItem, vhdxMetadataIsVirtualDisk, uint32(vhdxLogicalSectorSize))
+	add(vhdxPhysicalSectorSizeItem, vhdxMetadataIsVirtualDisk, uint32(vhdxPhysicalSectorSize))
+
+	var buf bytes.Buffer
+	header := struct {
+		Signature  [8]byte
+		Reserved   uint16
+		EntryCount uint16
+		Reserved2  [20]byte
+	}{EntryCount: uint16(len(entries))}
+	copy(header.Signature[:], "metadata")
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+	data := make([]byte, vhdxMetadataItemStart+items.Len())
+	copy(data, buf.Bytes())
+	copy(data[vhdxMetadataItemStart:], items.Bytes())
+	return data, nil
+}
+
+// writeVHDX writes a dynamically sized VHDX, only blocks containing data are allocated
+func writeVHDX(src Image, path string) error {
+	size := roundUp(src.Size(), vhdxLogicalSectorSize)
+	blocks := (size + vhdxBlockSize - 1) / vhdxBlockSize
+	// a sector bitmap entry is interleaved after every chunkRatio payload entries
+	chunkRatio := int64(1<<23) * vhdxLogicalSectorSize / vhdxBlockSize
+	batEntries := blocks
+	if blocks > 0 {
+		batEntries += (blocks - 1) / chunkRatio
+	}
+	batLength := roundUp(batEntries*8, mb)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	identifier := make([]byte, 64*1024)
+	copy(identifier, vhdxSignature)
+	for i, c := range utf16.Encode([]rune("image-builder")) {
+		binary.LittleEndian.PutUint16(identifier[8+i*2:], c)
+	}
+	if _, err := f.WriteAt(identifier, 0); err != nil {
+		return err
+	}
+
+	fileWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	dataWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	for i, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		header := vhdxHeader{
+			SequenceNumber: uint64(i),
+			FileWriteGUID:  fileWrite,
+			DataWriteGUID:  dataWrite,
+			Version:        1,
+			LogLength:      vhdxLogLength,
+			LogOffset:      vhdxLogOffset,
+		}
+		copy(header.Signature[:], "head")
+		data, err := checksummed(header, 4096)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return err
+		}
+	}
+
+	regions, err := vhdxRegionTable(uint32(batLength))
+	if err != nil {
+		return err
+	}
+	for _, offset := range []int64{vhdxRegion1Offset, vhdxRegion2Offset} {
+		if _, err := f.WriteAt(regions, offset); err != nil {
+			return err
+		}
+	}
+
+	metadata, err := vhdxMetadata(size)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(metadata, vhdxMetadataOffset); err != nil {
+		return err
+	}
+
+	bat := make([]uint64, batEntries)
+	next := int64(vhdxBATOffset) + batLength
+	block := make([]byte, vhdxBlockSize)
+	for i := int64(0); i < blocks; i++ {
+		chunk := block
+		if remaining := size - i*vhdxBlockSize; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		data, err := readChunk(src, chunk, i*vhdxBlockSize)
+		if err != nil {
+			return err
+		}
+		if !data {
+			continue
+		}
+		if _, err := f.WriteAt(chunk, next); err != nil {
+			return err
+		}
+		bat[i+i/chunkRatio] = uint64(next/mb)<<20 | vhdxPayloadFullyPresent
+		next += vhdxBlockSize
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, bat); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(buf.Bytes(), vhdxBATOffset); err != nil {
+		return err
+	}
+	if err := f.Truncate(next); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,251 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+)
+
+var vmdkMagic = []byte{'K', 'D', 'M', 'V'}
+
+const (
+	vmdkMagicNumber     = 0x564d444b
+	vmdkGrainSectors    = 128
+	vmdkGrainSize       = vmdkGrainSectors * sectorSize
+	vmdkGTEntries       = 512
+	vmdkGDAtEnd         = 0xffffffffffffffff
+	vmdkFlagNewline     = 1 << 0
+	vmdkFlagCompressed  = 1 << 16
+	vmdkFlagMarkers     = 1 << 17
+	vmdkCompressDeflate = 1
+
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+// vmdkHeader is the SparseExtentHeader from the VMware Virtual Disk Format 5.0 specification
+type vmdkHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+type vmdkMetadataMarker struct {
+	NumSectors uint64
+	Size       uint32
+	Type       uint32
+	Pad        [496]byte
+}
+
+const vmdkDescriptor = `# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+ddb.virtualHWVersion = "4"
+`
+
+// sectorWriter tracks the current position in sectors of a sequentially written file
+type sectorWriter struct {
+	w   *bufio.Writer
+	pos int64
+}
+
+func (s *sectorWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *sectorWriter) sector() uint64 {
+	return uint64(s.pos / sectorSize)
+}
+
+// pad fills the remainder of the current sector with zeros
+func (s *sectorWriter) pad() error {
+	if rem := s.pos % sectorSize; rem != 0 {
+		_, err := s.Write(make([]byte, sectorSize-rem))
+		return err
+	}
+	return nil
+}
+
+func (s *sectorWriter) writeStruct(v interface{}) error {
+	return binary.Write(s, binary.LittleEndian, v)
+}
+
+// writeStreamOptimizedVMDK writes a compressed, sequentially readable VMDK suitable for use inside an OVA
+func writeStreamOptimizedVMDK(src Image, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := &sectorWriter{w: bufio.NewWriterSize(f, mb)}
+
+	capacity := roundUp(src.Size(), vmdkGrainSize) / sectorSize
+	grains := capacity / vmdkGrainSectors
+	tables := (grains + vmdkGTEntries - 1) / vmdkGTEntries
+
+	descriptor := fmt.Sprintf(vmdkDescriptor, rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+		capacity, path.Base(name), capacity/(255*63))
+	descriptorSectors := roundUp(int64(len(descriptor)), sectorSize) / sectorSize
+
+	header := vmdkHeader{
+		MagicNumber:        vmdkMagicNumber,
+		Version:            3,
+		Flags:              vmdkFlagNewline | vmdkFlagCompressed | vmdkFlagMarkers,
+		Capacity:           uint64(capacity),
+		GrainSize:          vmdkGrainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     uint64(descriptorSectors),
+		NumGTEsPerGT:       vmdkGTEntries,
+		GdOffset:           vmdkGDAtEnd,
+		OverHead:           uint64(roundUp(1+descriptorSectors, vmdkGrainSectors)),
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+		CompressAlgorithm:  vmdkCompressDeflate,
+	}
+	if err := w.writeStruct(header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, descriptor); err != nil {
+		return err
+	}
+	if _, err := w.Write(make([]byte, int64(header.OverHead)*sectorSize-w.pos)); err != nil {
+		return err
+	}
+
+	gd := make([]uint32, tables)
+	grain := make([]byte, vmdkGrainSize)
+	var compressed bytes.Buffer
+	for table := int64(0); table < tables; table++ {
+		gt := make([]uint32, vmdkGTEntries)
+		empty := true
+		for entry := int64(0); entry < vmdkGTEntries; entry++ {
+			index := table*vmdkGTEntries + entry
+			if index >= grains {
+				break
+			}
+			data, err := readChunk(src, grain, index*vmdkGrainSize)
+			if err != nil {
+				return err
+			}
+			if !data {
+				continue
+			}
+			compressed.Reset()
+			zw := zlib.NewWriter(&compressed)
+			if _, err := zw.Write(grain); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			gt[entry] = uint32(w.sector())
+			empty = false
+			// grain marker: LBA and compressed size followed directly by the data
+			if err := w.writeStruct(struct {
+				LBA  uint64
+				Size uint32
+			}{uint64(index * vmdkGrainSectors), uint32(compressed.Len())}); err != nil {
+				return err
+			}
+			if _, err := w.Write(compressed.Bytes()); err != nil {
+				return err
+			}
+			if err := w.pad(); err != nil {
+				return err
+			}
+		}
+		if empty {
+			continue
+		}
+		if err := w.writeStruct(vmdkMetadataMarker{NumSectors: vmdkGTEntries * 4 / sectorSize, Type: vmdkMarkerGT}); err != nil {
+			return err
+		}
+		gd[table] = uint32(w.sector())
+		if err := w.writeStruct(gt); err != nil {
+			return err
+		}
+	}
+
+	gdSectors := roundUp(tables*4, sectorSize) / sectorSize
+	if err := w.writeStruct(vmdkMetadataMarker{NumSectors: uint64(gdSectors), Type: vmdkMarkerGD}); err != nil {
+		return err
+	}
+	header.GdOffset = w.sector()
+	if err := w.writeStruct(gd); err != nil {
+		return err
+	}
+	if err := w.pad(); err != nil {
+		return err
+	}
+
+	if err := w.writeStruct(vmdkMetadataMarker{NumSectors: 1, Type: vmdkMarkerFooter}); err != nil {
+		return err
+	}
+	if err := w.writeStruct(header); err != nil {
+		return err
+	}
+	if err := w.writeStruct(vmdkMetadataMarker{Type: vmdkMarkerEOS}); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,119 @@
+package converters
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/flanksource/commons/files"
+	"github.com/flanksource/commons/logger"
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/oci"
+	"sigs.k8s.io/image-builder/pkg/registry"
+)
+
+// DockerToOCI saves a docker image from the local daemon as an OCI image layout tarball, multi-platform
+// images are already built as an OCI layout which is copied instead
+func DockerToOCI(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	image := to.(api.OCIImage)
+	docker := from.(api.DockerImage)
+	if image.URL == "" {
+		image.URL = strings.NewReplacer("/", "-", ":", "-").Replace(docker.String()) + ".tar"
+	}
+	if image.Ref == "" {
+		image.Ref = docker.Tag
+	}
+	if docker.Archive != "" {
+		return copyArchive(docker.Archive, image)
+	}
+
+	tmp, err := ioutil.TempFile("", "docker-save*.tar")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := ctx.GetBinary("docker")("save -o %s %s", tmp.Name(), docker); err != nil {
+		return nil, fmt.Errorf("failed to save %s: %v", docker, err)
+	}
+
+	f, err := os.Create(image.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	logger.Infof("Writing OCI image %s to %s", docker, image.URL)
+	desc, err := oci.FromDockerArchive(tmp.Name(), f, image.Ref)
+	if err != nil {
+		return nil, err
+	}
+	image.Digest = desc.Digest
+	return image, nil
+}
+
+// copyArchive copies an existing OCI layout, the image is the first entry in its index
+func copyArchive(src string, image api.OCIImage) (api.Image, error) {
+	if src != image.URL {
+		logger.Infof("Copying OCI image %s to %s", src, image.URL)
+		if err := files.Copy(src, image.URL); err != nil {
+			return nil, err
+		}
+	}
+	archive, err := oci.OpenArchive(image.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	index, err := archive.Index()
+	if err != nil {
+		return nil, err
+	}
+	if len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("no images found in %s", image.URL)
+	}
+	image.Digest = index.Manifests[0].Digest
+	// the tag is set by buildx when the layout is created
+	image.Ref = index.Manifests[0].Annotations[oci.AnnotationRefName]
+	return image, nil
+}
+
+// validTag matches the tags accepted by registries
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// OCIToRegistry pushes an OCI image layout tarball to a registry, returning the digest of the pushed image
+func OCIToRegistry(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	image := to.(api.Registry)
+	layout := from.(api.OCIImage)
+	repo, err := registry.ParseRepository(image.Repository)
+	if err != nil {
+		return nil, err
+	}
+	repo.Username, repo.Password, repo.Insecure = image.Username, image.Password, image.Insecure
+	if repo.Username == "" {
+		repo.Username, repo.Password = os.Getenv("REGISTRY_USERNAME"), os.Getenv("REGISTRY_PASSWORD")
+	}
+	if err := repo.LoadDockerCredentials(); err != nil {
+		return nil, err
+	}
+
+	tags := image.Tags
+	if len(tags) == 0 {
+		// refs such as those written by buildx may include the repository
+		tag := layout.Ref[strings.LastIndex(layout.Ref, ":")+1:]
+		if !validTag.MatchString(tag) {
+			tag = "latest"
+		}
+		tags = []string{tag}
+	}
+	logger.Infof("Pushing %s to %s", layout, repo)
+	if image.Digest, err = repo.PushArchive(layout.URL, layout.Ref, tags); err != nil {
+		return nil, fmt.Errorf("failed to push to %s: %v", repo, err)
+	}
+	logger.Infof("Pushed %s@%s", repo, image.Digest)
+	// the pushed image is recorded in the build history, so it must not include the credentials
+	image.Username, image.Password = "", ""
+	return image, nil
+}
@@ -0,0 +1,109 @@
+package converters
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/flanksource/commons/files"
+	"github.com/flanksource/commons/logger"
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/converters/disk"
+	"sigs.k8s.io/image-builder/pkg/converters/ovf"
+)
+
+func OVAToVM(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	ova := from.(api.OVA)
+	vm := to.(api.VM)
+	tmp, _ := ioutil.TempFile("", "options*.json")
+	tmp.WriteString(getOptions(vm.Network))
+	if !logger.IsTraceEnabled() {
+		defer os.Remove(tmp.Name())
+	}
+	govc := ctx.GetBinary("govc")
+	if err := govc("import.ova --name %s --options %s %s", vm.Name, tmp.Name(), ova.URL); err != nil {
+		return nil, err
+	}
+	if vm.Hardware.IsEmpty() {
+		return vm, nil
+	}
+	// unset fields are validated with the defaults used when the OVA was created
+	if err := vm.Hardware.WithDefaults().Validate(); err != nil {
+		return nil, err
+	}
+	// firmware, controllers and NICs are fixed by the OVA, everything else can be changed after import
+	args := fmt.Sprintf("vm.change -vm %s", vm.Name)
+	if vm.Hardware.CPUs > 0 {
+		args += fmt.Sprintf(" -c %d", vm.Hardware.CPUs)
+	}
+	if vm.Hardware.Memory > 0 {
+		args += fmt.Sprintf(" -m %d", vm.Hardware.Memory)
+	}
+	if vm.Hardware.GuestOS != "" {
+		args += fmt.Sprintf(" -g %s", vm.Hardware.GuestOS)
+	}
+	for _, pair := range ovf.VMXKeys(vm.Hardware) {
+		args += fmt.Sprintf(" -e '%s'", pair)
+	}
+	if err := govc(args); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+func VmdkToOVA(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	vmdk := from.(api.VMDK)
+	ova := to.(api.OVA)
+	capacity, err := disk.VirtualSize(vmdk.URL)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Dir(vmdk.URL)
+	descriptor := ovf.Descriptor{
+		Name:       files.GetBaseName(vmdk.URL),
+		Hardware:   ova.Hardware,
+		Properties: ova.Properties,
+		EULA:       ova.EULA,
+		Disks:      []ovf.Disk{{Path: vmdk.URL, Capacity: capacity}},
+	}
+	// a vmx is written alongside the OVA so that the disk can be run directly by desktop hypervisors
+	vmx, err := descriptor.VMX()
+	if err != nil {
+		return nil, err
+	}
+	logger.Tracef(vmx)
+	if err := ioutil.WriteFile(path.Join(dir, descriptor.Name+".vmx"), []byte(vmx), 0644); err != nil {
+		return nil, err
+	}
+	if ova.URL, err = ovf.Package(descriptor, dir); err != nil {
+		return nil, err
+	}
+	return ova, nil
+}
+
+func getOptions(network string) string {
+	return fmt.Sprintf(options, network)
+}
+
+var (
+	options = `
+	{
+    "DiskProvisioning": "thin",
+    "IPAllocationPolicy": "dhcpPolicy",
+    "IPProtocol": "IPv4",
+    "NetworkMapping": [
+        {
+            "Name": "VM Network",
+            "Network": "%s"
+        }
+    ],
+    "MarkAsTemplate": false,
+    "PowerOn": false,
+    "InjectOvfEnv": false,
+    "WaitForIP": false,
+    "Name": null
+}
+`
+)
@@ -0,0 +1,131 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package ovf
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Package writes <name>.ovf and a <name>.mf manifest into dir, and then packs them together
+// with the disks into <name>.ova, returning the path to the OVA.
+func Package(d Descriptor, dir string) (string, error) {
+	for i, disk := range d.Disks {
+		info, err := os.Stat(disk.Path)
+		if err != nil {
+			return "", err
+		}
+		d.Disks[i].Size = info.Size()
+	}
+
+	ovf, err := d.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate OVF descriptor: %v", err)
+	}
+	ovfPath := path.Join(dir, d.Name+".ovf")
+	if err := ioutil.WriteFile(ovfPath, ovf, 0644); err != nil {
+		return "", err
+	}
+
+	// the descriptor must be first, followed by the manifest and then the files in the order they are referenced
+	contents := []string{ovfPath}
+	for _, disk := range d.Disks {
+		contents = append(contents, disk.Path)
+	}
+	manifest, err := Manifest(contents...)
+	if err != nil {
+		return "", err
+	}
+	mfPath := path.Join(dir, d.Name+".mf")
+	if err := ioutil.WriteFile(mfPath, []byte(manifest), 0644); err != nil {
+		return "", err
+	}
+	contents = append([]string{ovfPath, mfPath}, contents[1:]...)
+
+	ova := path.Join(dir, d.Name+".ova")
+	if err := tarFiles(ova, contents...); err != nil {
+		os.Remove(ova)
+		return "", fmt.Errorf("failed to create %s: %v", ova, err)
+	}
+	return ova, nil
+}
+
+// Manifest returns an OVF manifest containing the SHA256 digest of each file
+func Manifest(files ...string) (string, error) {
+	var manifest strings.Builder
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&manifest, "SHA256(%s)= %x\n", path.Base(file), hash.Sum(nil))
+	}
+	return manifest.String(), nil
+}
+
+func tarFiles(to string, files ...string) error {
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := tar.NewWriter(out)
+	for _, file := range files {
+		if err := addFile(w, file); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func addFile(w *tar.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := w.WriteHeader(&tar.Header{
+		Name:    path.Base(file),
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Format:  tar.FormatUSTAR,
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
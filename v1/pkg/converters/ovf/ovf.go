@@ -0,0 +1,251 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package ovf generates OVF descriptors and OVA packages without requiring ovftool
+package ovf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/image-builder/api"
+)
+
+const (
+	DefaultNetwork = "VM Network"
+	vmdkFormat     = "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"
+)
+
+// Disk is a virtual disk referenced by the descriptor
+type Disk struct {
+	// Path is the local path to the disk, only the basename is used inside the OVA
+	Path string
+	// Size is the size of the disk file in bytes
+	Size int64
+	// Capacity is the virtual size of the disk in bytes
+	Capacity int64
+}
+
+// Descriptor describes a virtual machine to be packaged as an OVF
+type Descriptor struct {
+	Name       string
+	Hardware   api.Hardware
+	Network    string
+	Disks      []Disk
+	Properties map[string]string
+	EULA       string
+}
+
+type property struct {
+	Key   string
+	Value string
+}
+
+// osTypes maps VMware guest identifiers to CIM operating system types
+var osTypes = []struct {
+	prefix string
+	id     int
+}{
+	{"ubuntu64", 94},
+	{"ubuntu", 93},
+	{"debian", 96},
+	{"centos", 107},
+	{"rhel", 80},
+}
+
+func (d Descriptor) osType() int {
+	for _, os := range osTypes {
+		if strings.HasPrefix(d.Hardware.GuestOS, os.prefix) {
+			return os.id
+		}
+	}
+	// Linux 2.6.x 64-bit
+	return 101
+}
+
+func sorted(m map[string]string) []property {
+	var properties []property
+	for k, v := range m {
+		properties = append(properties, property{k, v})
+	}
+	sort.Slice(properties, func(i, j int) bool { return properties[i].Key < properties[j].Key })
+	return properties
+}
+
+// controller returns the CIM resource type and subtype of a disk controller
+func controller(name string) (int, string) {
+	switch name {
+	case "ide":
+		return 5, ""
+	case "sata":
+		return 20, "vmware.sata.ahci"
+	case "nvme":
+		return 20, "vmware.nvme.controller"
+	case "pvscsi":
+		return 6, "VirtualSCSI"
+	}
+	return 6, name
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func basename(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// Marshal renders the descriptor as an OVF 1.0 envelope
+func (d Descriptor) Marshal() ([]byte, error) {
+	d.Hardware = d.Hardware.WithDefaults()
+	if err := d.Hardware.Validate(); err != nil {
+		return nil, err
+	}
+	if d.Network == "" {
+		d.Network = DefaultNetwork
+	}
+	tpl, err := template.New("ovf").Funcs(template.FuncMap{
+		"xml":      escape,
+		"basename": basename,
+		"sorted":   sorted,
+		"add":      func(a, b int) int { return a + b },
+	}).Parse(envelope)
+	if err != nil {
+		return nil, err
+	}
+	controllerType, controllerSubType := controller(d.Hardware.DiskController)
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, struct {
+		Descriptor
+		OSType            int
+		Format            string
+		ControllerType    int
+		ControllerSubType string
+	}{d, d.osType(), vmdkFormat, controllerType, controllerSubType}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rasd elements within an Item must be in alphabetical order
+const envelope = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:cim="http://schemas.dmtf.org/wbem/wscim/1/common" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+{{- range $i, $disk := .Disks }}
+    <File ovf:href="{{ basename $disk.Path | xml }}" ovf:id="file{{ add $i 1 }}" ovf:size="{{ $disk.Size }}"/>
+{{- end }}
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+{{- range $i, $disk := .Disks }}
+    <Disk ovf:capacity="{{ $disk.Capacity }}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk{{ add $i 1 }}" ovf:fileRef="file{{ add $i 1 }}" ovf:format="{{ $.Format }}"/>
+{{- end }}
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="{{ .Network | xml }}">
+      <Description>The {{ .Network | xml }} network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{ .Name | xml }}">
+    <Info>A virtual machine</Info>
+    <Name>{{ .Name | xml }}</Name>
+    <OperatingSystemSection ovf:id="{{ .OSType }}" vmw:osType="{{ .Hardware.GuestOS | xml }}">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{ .Name | xml }}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-{{ printf "%02d" .Hardware.Version }}</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{ .Hardware.CPUs }} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{ .Hardware.CPUs }}</rasd:VirtualQuantity>
+        <vmw:CoresPerSocket ovf:required="false">{{ .Hardware.CoresPerSocket }}</vmw:CoresPerSocket>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{ .Hardware.Memory }}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{ .Hardware.Memory }}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>{{ .Hardware.DiskController }} controller</rasd:Description>
+        <rasd:ElementName>Disk Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+{{- if .ControllerSubType }}
+        <rasd:ResourceSubType>{{ .ControllerSubType }}</rasd:ResourceSubType>
+{{- end }}
+        <rasd:ResourceType>{{ .ControllerType }}</rasd:ResourceType>
+      </Item>
+{{- range $i, $disk := .Disks }}
+      <Item>
+        <rasd:AddressOnParent>{{ $i }}</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk {{ add $i 1 }}</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk{{ add $i 1 }}</rasd:HostResource>
+        <rasd:InstanceID>{{ add $i 5 }}</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+{{- end }}
+      <Item>
+        <rasd:AddressOnParent>7</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>{{ .Network | xml }}</rasd:Connection>
+        <rasd:Description>{{ .Hardware.NIC | xml }} ethernet adapter on &quot;{{ .Network | xml }}&quot;</rasd:Description>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:ResourceSubType>{{ .Hardware.NIC | xml }}</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="{{ .Hardware.Firmware }}"/>
+{{- range sorted .Hardware.ExtraConfig }}
+      <vmw:ExtraConfig ovf:required="false" vmw:key="{{ .Key | xml }}" vmw:value="{{ .Value | xml }}"/>
+{{- end }}
+    </VirtualHardwareSection>
+{{- if .Properties }}
+    <ProductSection>
+      <Info>Information about the installed software</Info>
+      <Product>{{ .Name | xml }}</Product>
+{{- range sorted .Properties }}
+      <Property ovf:key="{{ .Key | xml }}" ovf:type="string" ovf:userConfigurable="true" ovf:value="{{ .Value | xml }}"/>
+{{- end }}
+    </ProductSection>
+{{- end }}
+{{- if .EULA }}
+    <EulaSection>
+      <Info>An end-user license agreement</Info>
+      <License>{{ .EULA | xml }}</License>
+    </EulaSection>
+{{- end }}
+  </VirtualSystem>
+</Envelope>
+`
@@ -0,0 +1,158 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package ovf
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/image-builder/api"
+)
+
+// vmxDefaults are the settings common to every generated vmx
+var vmxDefaults = map[string]string{
+	".encoding":                        "UTF-8",
+	"answer.msg.serial.file.open":      "Replace",
+	"answer.msg.uuid.altered":          "I copied it",
+	"cleanShutdown":                    "TRUE",
+	"config.version":                   "8",
+	"disk.enableUUID":                  "1",
+	"ethernet0.addressType":            "generated",
+	"ethernet0.connectionType":         "bridged",
+	"ethernet0.generatedAddressOffset": "0",
+	"ethernet0.present":                "TRUE",
+	"ethernet0.uptCompatibility":       "TRUE",
+	"ethernet0.wakeOnPcktRcv":          "FALSE",
+	"floppy0.present":                  "FALSE",
+	"hpet0.present":                    "TRUE",
+	"pciBridge0.present":               "TRUE",
+	"pciBridge4.functions":             "8",
+	"pciBridge4.present":               "TRUE",
+	"pciBridge4.virtualDev":            "pcieRootPort",
+	"pciBridge5.functions":             "8",
+	"pciBridge5.present":               "TRUE",
+	"pciBridge5.virtualDev":            "pcieRootPort",
+	"pciBridge6.functions":             "8",
+	"pciBridge6.present":               "TRUE",
+	"pciBridge6.virtualDev":            "pcieRootPort",
+	"pciBridge7.functions":             "8",
+	"pciBridge7.present":               "TRUE",
+	"pciBridge7.virtualDev":            "pcieRootPort",
+	"serial0.fileName":                 "serial.out",
+	"serial0.fileType":                 "file",
+	"serial0.present":                  "TRUE",
+	"svga.present":                     "TRUE",
+	"svga.vramSize":                    "134217728",
+	"tools.syncTime":                   "FALSE",
+	"toolScripts.afterPowerOn":         "TRUE",
+	"toolScripts.afterResume":          "TRUE",
+	"toolScripts.beforePowerOff":       "TRUE",
+	"toolScripts.beforeSuspend":        "TRUE",
+	"virtualHW.productCompatibility":   "hosted",
+	"vmci0.present":                    "TRUE",
+	"vmci0.unrestricted":               "FALSE",
+}
+
+// vmxGuestOS converts a guest identifier such as ubuntu64Guest into its vmx form ubuntu-64
+func vmxGuestOS(guestID string) string {
+	guest := strings.ToLower(strings.TrimSuffix(guestID, "Guest"))
+	switch {
+	case strings.HasSuffix(guest, "_64"):
+		return strings.TrimSuffix(guest, "_64") + "-64"
+	case strings.HasSuffix(guest, "64"):
+		return strings.TrimSuffix(guest, "64") + "-64"
+	}
+	return guest
+}
+
+// vmxDisk returns the vmx device prefix for the first disk and the settings for its controller
+func vmxDisk(controller string) (string, map[string]string) {
+	switch controller {
+	case "ide":
+		return "ide0:0", map[string]string{}
+	case "sata":
+		return "sata0:0", map[string]string{"sata0.present": "TRUE"}
+	case "nvme":
+		return "nvme0:0", map[string]string{"nvme0.present": "TRUE"}
+	case "lsilogicsas":
+		controller = "lsisas1068"
+	}
+	return "scsi0:0", map[string]string{"scsi0.present": "TRUE", "scsi0.virtualDev": controller}
+}
+
+// VMX renders the descriptor as a vmx configuration, keys are sorted so that
+// the same descriptor always produces the same output.
+func (d Descriptor) VMX() (string, error) {
+	hw := d.Hardware.WithDefaults()
+	if err := hw.Validate(); err != nil {
+		return "", err
+	}
+	network := d.Network
+	if network == "" {
+		network = DefaultNetwork
+	}
+	vmx := make(map[string]string)
+	for k, v := range vmxDefaults {
+		vmx[k] = v
+	}
+	vmx["displayName"] = d.Name
+	vmx["guestOS"] = vmxGuestOS(hw.GuestOS)
+	vmx["numvcpus"] = fmt.Sprintf("%d", hw.CPUs)
+	vmx["cpuid.coresPerSocket"] = fmt.Sprintf("%d", hw.CoresPerSocket)
+	vmx["memSize"] = fmt.Sprintf("%d", hw.Memory)
+	vmx["virtualhw.version"] = fmt.Sprintf("%d", hw.Version)
+	vmx["firmware"] = hw.Firmware
+	vmx["ethernet0.virtualDev"] = hw.NIC
+	vmx["ethernet0.networkName"] = network
+
+	device, controller := vmxDisk(hw.DiskController)
+	for k, v := range controller {
+		vmx[k] = v
+	}
+	for i, disk := range d.Disks {
+		prefix := fmt.Sprintf("%s%d", device[:len(device)-1], i)
+		vmx[prefix+".deviceType"] = "disk"
+		vmx[prefix+".fileName"] = basename(disk.Path)
+		vmx[prefix+".mode"] = "persistent"
+		vmx[prefix+".present"] = "TRUE"
+	}
+	for k, v := range hw.ExtraConfig {
+		vmx[k] = v
+	}
+
+	var out strings.Builder
+	for _, p := range sorted(vmx) {
+		fmt.Fprintf(&out, "%s = \"%s\"\n", p.Key, p.Value)
+	}
+	return out.String(), nil
+}
+
+// VMXKeys renders the typed hardware as sorted key=value pairs that can be applied to an existing VM
+func VMXKeys(hw api.Hardware) []string {
+	keys := make(map[string]string)
+	if hw.CoresPerSocket > 0 {
+		keys["cpuid.coresPerSocket"] = fmt.Sprintf("%d", hw.CoresPerSocket)
+	}
+	for k, v := range hw.ExtraConfig {
+		keys[k] = v
+	}
+	var pairs []string
+	for _, p := range sorted(keys) {
+		pairs = append(pairs, p.Key+"="+p.Value)
+	}
+	return pairs
+}
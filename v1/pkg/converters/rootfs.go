@@ -0,0 +1,572 @@
+package converters
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/commons/logger"
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/engines"
+	"sigs.k8s.io/image-builder/pkg/fat"
+	"sigs.k8s.io/image-builder/pkg/oci"
+	"sigs.k8s.io/image-builder/pkg/partitions"
+)
+
+const (
+	bootloaderGrub        = "grub"
+	bootloaderSystemdBoot = "systemd-boot"
+
+	mib = int64(1024 * 1024)
+	gib = 1024 * mib
+	// espSize is the minimum size of the EFI system partition, FAT32 requires at least 33MB
+	espSize = 256 * mib
+	// defaultKernelArgs enable both the graphical and serial console
+	defaultKernelArgs = "console=tty0 console=ttyS0,115200"
+	// staging is where the bootloader is built inside the rootfs, it is removed before the disk is created
+	staging = "/tmp/image-builder"
+)
+
+// efiArch is the naming of an architecture by UEFI and grub
+type efiArch struct {
+	// name is the suffix of the removable media boot path, e.g. EFI/BOOT/BOOTX64.EFI
+	name string
+	grub string
+}
+
+var efiArchs = map[string]efiArch{
+	"amd64": {name: "x64", grub: "x86_64-efi"},
+	"arm64": {name: "aa64", grub: "arm64-efi"},
+}
+
+// installScript installs a kernel, an init system and the bootloader tools if they are missing, the bootloader and
+// architecture are set by variables prepended to the script. grub is built as a standalone EFI binary that loads its
+// config from the ESP, as grub-install requires the disk to be attached.
+const installScript = `
+kernel=$(ls /boot/vmlinuz* /lib/modules/*/vmlinuz /usr/lib/modules/*/vmlinuz 2>/dev/null || true)
+packages=""
+if command -v apt-get > /dev/null; then
+  export DEBIAN_FRONTEND=noninteractive
+  arch=$(dpkg --print-architecture)
+  if [ -z "$kernel" ]; then
+    if grep -q '^ID=ubuntu' /etc/os-release; then packages="linux-image-virtual"; else packages="linux-image-$arch"; fi
+    packages="$packages initramfs-tools"
+  fi
+  [ -e /sbin/init ] || packages="$packages systemd-sysv"
+  if [ "$BOOTLOADER" = grub ]; then
+    command -v grub-mkimage > /dev/null && [ -d /usr/lib/grub/$GRUB_TARGET ] || packages="$packages grub-efi-$arch-bin"
+  else
+    [ -e /usr/lib/systemd/boot/efi/systemd-boot$EFI_ARCH.efi ] || packages="$packages systemd-boot-efi"
+  fi
+  if [ -n "$packages" ]; then
+    # services must not be started inside the chroot
+    printf '#!/bin/sh\nexit 101\n' > /usr/sbin/policy-rc.d
+    chmod +x /usr/sbin/policy-rc.d
+    apt-get update
+    apt-get install -y --no-install-recommends $packages
+    rm -rf /usr/sbin/policy-rc.d /var/lib/apt/lists/*
+  fi
+elif command -v dnf > /dev/null || command -v yum > /dev/null; then
+  if [ -z "$kernel" ]; then
+    # the initramfs must not only include the drivers of the build host
+    mkdir -p /etc/dracut.conf.d
+    echo 'hostonly="no"' > /etc/dracut.conf.d/image-builder.conf
+    packages="kernel"
+  fi
+  [ -e /sbin/init ] || packages="$packages systemd"
+  if [ "$BOOTLOADER" = grub ]; then
+    command -v grub2-mkimage > /dev/null && [ -d /usr/lib/grub/$GRUB_TARGET ] || packages="$packages grub2-tools grub2-efi-$EFI_ARCH-modules"
+  else
+    [ -e /usr/lib/systemd/boot/efi/systemd-boot$EFI_ARCH.efi ] || packages="$packages systemd-boot-unsigned"
+  fi
+  if [ -n "$packages" ]; then
+    $(command -v dnf || command -v yum) install -y $packages
+    $(command -v dnf || command -v yum) clean all
+  fi
+elif command -v apk > /dev/null; then
+  [ -n "$kernel" ] || packages="linux-virt"
+  [ -e /sbin/init ] || packages="$packages openrc"
+  if [ "$BOOTLOADER" = grub ]; then
+    command -v grub-mkimage > /dev/null || packages="$packages grub-efi"
+  elif [ ! -e /usr/lib/systemd/boot/efi/systemd-boot$EFI_ARCH.efi ]; then
+    echo "systemd-boot is not available for alpine, use grub instead"
+    exit 1
+  fi
+  [ -z "$packages" ] || apk add --no-cache $packages
+elif [ -z "$kernel" ]; then
+  echo "no kernel found and no supported package manager to install one with"
+  exit 1
+fi
+
+# kernels that were installed without an initramfs, e.g. by dnf when dracut is not configured for a container
+for dir in /lib/modules/*; do
+  [ -d "$dir" ] || continue
+  version=$(basename $dir)
+  if [ -e /boot/initrd.img-$version ] || [ -e /boot/initramfs-$version.img ]; then
+    continue
+  elif command -v dracut > /dev/null; then
+    dracut --no-hostonly --force /boot/initramfs-$version.img $version
+  elif command -v update-initramfs > /dev/null; then
+    update-initramfs -c -k $version
+  fi
+done
+
+if [ "$BOOTLOADER" = grub ]; then
+  $(command -v grub-mkimage || command -v grub2-mkimage) -O $GRUB_TARGET -p /EFI/BOOT -o $STAGING/boot.efi \
+    part_gpt fat ext2 normal linux configfile search search_fs_uuid echo test gzio all_video
+fi
+`
+
+// OCIToDiskImage builds a bootable disk image from the filesystem of a container image
+func OCIToDiskImage(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	image := to.(api.DiskImage)
+	if image.URL == "" {
+		image.URL = diskURL(from.String(), "img")
+	}
+	return buildDisk(ctx, image, func(root string) error {
+		archive, err := oci.OpenArchive(from.String())
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		manifest, err := archive.Image(oci.Platform{OS: "linux", Architecture: runtime.GOARCH})
+		if err != nil {
+			return fmt.Errorf("%s: %v", from, err)
+		}
+		logger.Infof("Unpacking %s", from)
+		for _, layer := range manifest.Layers {
+			r, err := archive.Blob(layer.Digest)
+			if err != nil {
+				return err
+			}
+			if err := oci.Unpack(r, root); err != nil {
+				return fmt.Errorf("failed to unpack %s: %v", layer.Digest, err)
+			}
+		}
+		return nil
+	})
+}
+
+// RootFSToDiskImage builds a bootable disk image from a rootfs directory or tarball
+func RootFSToDiskImage(ctx *pkg.BuildContext, from api.Image, to api.Image) (api.Image, error) {
+	image := to.(api.DiskImage)
+	src := strings.TrimSuffix(from.String(), "/")
+	if image.URL == "" {
+		image.URL = diskURL(strings.TrimSuffix(strings.TrimSuffix(src, ".gz"), ".tar"), "img")
+	}
+	return buildDisk(ctx, image, func(root string) error {
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Copying %s", src)
+		if info.IsDir() {
+			return ctx.GetBinary("cp")("-a %s/. %s", src, root)
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return oci.Unpack(f, root)
+	})
+}
+
+// buildDisk creates a GPT partitioned disk with an EFI system partition and an ext4 root partition containing the
+// rootfs extracted by extract, after installing a kernel and bootloader into it
+func buildDisk(ctx *pkg.BuildContext, image api.DiskImage, extract func(root string) error) (api.Image, error) {
+	arch, ok := efiArchs[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("building disk images is not supported on %s", runtime.GOARCH)
+	}
+	if image.Bootloader == "" {
+		image.Bootloader = bootloaderGrub
+	}
+	if image.Bootloader != bootloaderGrub && image.Bootloader != bootloaderSystemdBoot {
+		return nil, fmt.Errorf("invalid bootloader %s, must be either %s or %s", image.Bootloader, bootloaderGrub, bootloaderSystemdBoot)
+	}
+	if ctx.DryRun {
+		return image, nil
+	}
+	// ownership is only preserved when the rootfs is extracted as root, which is also required to chroot
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("building a disk image must be run as root")
+	}
+
+	dir, err := ioutil.TempDir("", "image-builder-disk")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := engines.RemoveRoot(dir); err != nil {
+			logger.Warnf("%v", err)
+		}
+	}()
+	root := path.Join(dir, "rootfs")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return nil, err
+	}
+	if err := extract(root); err != nil {
+		return nil, err
+	}
+
+	stage, err := oci.SafePath(root, staging+"/install.sh")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Dir(stage), 0755); err != nil {
+		return nil, err
+	}
+	vars := fmt.Sprintf("BOOTLOADER=%s\nEFI_ARCH=%s\nGRUB_TARGET=%s\nSTAGING=%s\n", image.Bootloader, arch.name, arch.grub, staging)
+	if err := ioutil.WriteFile(stage, []byte(vars+installScript), 0755); err != nil {
+		return nil, err
+	}
+	logger.Infof("Installing the kernel and %s", image.Bootloader)
+	if err := engines.RunInChroot(*ctx, root, "sh -ex "+staging+"/install.sh"); err != nil {
+		return nil, fmt.Errorf("failed to install the kernel and bootloader: %v", err)
+	}
+	boot, err := newBootConfig(root, image, arch)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(path.Dir(stage)); err != nil {
+		return nil, err
+	}
+	if err := boot.writeFstab(root); err != nil {
+		return nil, err
+	}
+
+	raw := image.URL
+	if path.Ext(image.URL) == ".qcow2" {
+		raw = path.Join(dir, "disk.img")
+	}
+	if err := boot.writeDisk(ctx, raw, root, dir, int64(image.SizeGB)*gib); err != nil {
+		os.Remove(raw)
+		return nil, err
+	}
+	if raw != image.URL {
+		if err := ctx.GetBinary("qemu-img")("convert -O qcow2 %s %s", raw, image.URL); err != nil {
+			return nil, fmt.Errorf("failed to convert %s to qcow2: %v", image.URL, err)
+		}
+	}
+	logger.Infof("Created %s booting %s with %s", image.URL, boot.kernel, image.Bootloader)
+	return image, nil
+}
+
+// bootConfig is the kernel and bootloader of a disk, and the identifiers of its partitions
+type bootConfig struct {
+	name       string
+	bootloader string
+	efi        []byte
+	arch       efiArch
+	// kernel and initrd are paths inside the rootfs
+	kernel, initrd string
+	kernelArgs     string
+	rootUUID       string
+	espGUID        string
+}
+
+func newBootConfig(root string, image api.DiskImage, arch efiArch) (*bootConfig, error) {
+	boot := &bootConfig{name: osName(root), bootloader: image.Bootloader, arch: arch, kernelArgs: defaultKernelArgs}
+	if image.KernelArgs != "" {
+		boot.kernelArgs += " " + image.KernelArgs
+	}
+	var err error
+	if boot.kernel, boot.initrd, err = findKernel(root); err != nil {
+		return nil, err
+	}
+	efi := path.Join(staging, "boot.efi")
+	if image.Bootloader == bootloaderSystemdBoot {
+		efi = "/usr/lib/systemd/boot/efi/systemd-boot" + arch.name + ".efi"
+	}
+	if boot.efi, err = readFile(root, efi); err != nil {
+		return nil, fmt.Errorf("%s not found: %v", image.Bootloader, err)
+	}
+	if boot.rootUUID, err = partitions.NewGUID(); err != nil {
+		return nil, err
+	}
+	if boot.espGUID, err = partitions.NewGUID(); err != nil {
+		return nil, err
+	}
+	boot.rootUUID, boot.espGUID = strings.ToLower(boot.rootUUID), strings.ToLower(boot.espGUID)
+	return boot, nil
+}
+
+// osName returns the PRETTY_NAME from /etc/os-release, which is used for the boot menu entry
+func osName(root string) string {
+	for _, file := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		data, err := readFile(root, file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "PRETTY_NAME=") {
+				return strings.Trim(strings.TrimPrefix(scanner.Text(), "PRETTY_NAME="), `"'`)
+			}
+		}
+	}
+	return "Linux"
+}
+
+// resolve returns the location of name inside root, following symlinks relative to root rather than the host
+func resolve(root, name string) (string, error) {
+	for i := 0; i < 16; i++ {
+		target, err := oci.SafePath(root, name)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Lstat(target)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return path.Clean("/" + name), nil
+		}
+		link, err := os.Readlink(target)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(link) {
+			link = path.Join(path.Dir(path.Clean("/"+name)), link)
+		}
+		name = link
+	}
+	return "", fmt.Errorf("too many levels of symlinks: %s", name)
+}
+
+// readFile reads a file inside root
+func readFile(root, name string) ([]byte, error) {
+	name, err := resolve(root, name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(root, name))
+}
+
+// findKernel returns the newest kernel with an initramfs, as paths inside root
+func findKernel(root string) (string, string, error) {
+	kernels := make(map[string]string)
+	for _, pattern := range []string{"/boot/vmlinuz-*", "/lib/modules/*/vmlinuz", "/usr/lib/modules/*/vmlinuz"} {
+		matches, _ := filepath.Glob(filepath.Join(root, pattern))
+		for _, match := range matches {
+			kernel := "/" + filepath.ToSlash(strings.TrimPrefix(match, root+string(filepath.Separator)))
+			version := strings.TrimPrefix(path.Base(kernel), "vmlinuz-")
+			if path.Base(kernel) == "vmlinuz" {
+				version = path.Base(path.Dir(kernel))
+			}
+			if _, ok := kernels[version]; !ok {
+				kernels[version] = kernel
+			}
+		}
+	}
+	var versions []string
+	for version := range kernels {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versionLess(versions[i], versions[j]) })
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		for _, initrd := range []string{"/boot/initrd.img-" + version, "/boot/initramfs-" + version + ".img", "/boot/initramfs-" + version} {
+			if resolved, err := resolve(root, initrd); err == nil {
+				kernel, err := resolve(root, kernels[version])
+				if err != nil {
+					return "", "", err
+				}
+				return kernel, resolved, nil
+			}
+		}
+		logger.Warnf("Skipping kernel %s without an initramfs", version)
+	}
+	return "", "", fmt.Errorf("no kernel with an initramfs found")
+}
+
+// versionLess compares kernel versions such as 5.4.0-42-generic, numbers are compared numerically
+func versionLess(a, b string) bool {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' || r == '_' })
+	}
+	x, y := split(a), split(b)
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] == y[i] {
+			continue
+		}
+		m, errM := strconv.Atoi(x[i])
+		n, errN := strconv.Atoi(y[i])
+		if errM == nil && errN == nil {
+			return m < n
+		}
+		return x[i] < y[i]
+	}
+	return len(x) < len(y)
+}
+
+// writeFstab replaces the fstab of the rootfs, which in container images is usually a placeholder
+func (b *bootConfig) writeFstab(root string) error {
+	fstab, err := oci.SafePath(root, "/etc/fstab")
+	if err != nil {
+		return err
+	}
+	esp, err := oci.SafePath(root, "/boot/efi")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(esp, 0755); err != nil {
+		return err
+	}
+	os.Remove(fstab) // nolint: errcheck
+	return ioutil.WriteFile(fstab, []byte(fmt.Sprintf(
+		"UUID=%s / ext4 defaults 0 1\nPARTUUID=%s /boot/efi vfat umask=0077 0 2\n", b.rootUUID, b.espGUID)), 0644)
+}
+
+// espFiles returns the contents of the EFI system partition
+func (b *bootConfig) espFiles(root string) (map[string][]byte, error) {
+	files := map[string][]byte{
+		"EFI/BOOT/BOOT" + strings.ToUpper(b.arch.name) + ".EFI": b.efi,
+	}
+	cmdline := fmt.Sprintf("root=UUID=%s ro %s", b.rootUUID, b.kernelArgs)
+	if b.bootloader == bootloaderGrub {
+		files["EFI/BOOT/grub.cfg"] = []byte(fmt.Sprintf(`set timeout=1
+search --no-floppy --fs-uuid --set=root %s
+menuentry "%s" {
+	linux %s %s
+	initrd %s
+}
+`, b.rootUUID, b.name, b.kernel, cmdline, b.initrd))
+		return files, nil
+	}
+
+	// systemd-boot can only load the kernel from the ESP
+	for name, file := range map[string]string{"linux": b.kernel, "initrd": b.initrd} {
+		data, err := readFile(root, file)
+		if err != nil {
+			return nil, err
+		}
+		files["image-builder/"+name] = data
+	}
+	files["EFI/systemd/systemd-boot"+b.arch.name+".efi"] = b.efi
+	files["loader/loader.conf"] = []byte("timeout 1\ndefault image-builder.conf\n")
+	files["loader/entries/image-builder.conf"] = []byte(fmt.Sprintf(
+		"title %s\nlinux /image-builder/linux\ninitrd /image-builder/initrd\noptions %s\n", b.name, cmdline))
+	return files, nil
+}
+
+// writeDisk creates a raw disk of size bytes, or large enough to fit root if size is 0
+func (b *bootConfig) writeDisk(ctx *pkg.BuildContext, file, root, dir string, size int64) error {
+	files, err := b.espFiles(root)
+	if err != nil {
+		return err
+	}
+	esp := espSize
+	var total int64
+	for _, data := range files {
+		total += int64(len(data))
+	}
+	if total+64*mib > esp {
+		esp = roundUp(total+64*mib, mib)
+	}
+	used, err := diskUsage(root)
+	if err != nil {
+		return err
+	}
+	// the root filesystem needs room for its own metadata, and for the image to be usable
+	minimum := mib + esp + roundUp(used+used/5+512*mib, mib) + mib
+	if size == 0 {
+		size = roundUp(minimum, gib)
+	} else if size < minimum {
+		return fmt.Errorf("size_gb is too small, the rootfs needs at least %dGB", roundUp(minimum, gib)/gib)
+	}
+
+	espFile := path.Join(dir, "esp.img")
+	if err := fat.Create(espFile, esp, "ESP", files); err != nil {
+		return fmt.Errorf("failed to create the EFI system partition: %v", err)
+	}
+	rootStart := mib + esp
+	rootSize := size - rootStart - mib
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if err := partitions.WriteGPT(f, size, []partitions.Partition{
+		{Start: mib, Size: esp, Type: partitions.TypeESP, GUID: strings.ToUpper(b.espGUID), Name: "ESP"},
+		{Start: rootStart, Size: rootSize, Type: partitions.TypeLinux, Name: "root"},
+	}); err != nil {
+		return err
+	}
+	if err := copyAt(f, mib, espFile); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	logger.Infof("Creating the root filesystem")
+	if err := ctx.GetBinary("mkfs.ext4")("-q -F -L root -U %s -d %s -E offset=%d %s %dk",
+		b.rootUUID, root, rootStart, file, rootSize/1024); err != nil {
+		return fmt.Errorf("failed to create the root filesystem: %v", err)
+	}
+	return nil
+}
+
+// diskUsage returns the space used by the files under root, including a block for each file
+func diskUsage(root string) (int64, error) {
+	var used int64
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		used += roundUp(info.Size(), 4096) + 4096
+		return nil
+	})
+	return used, err
+}
+
+func roundUp(n, to int64) int64 {
+	return (n + to - 1) / to * to
+}
+
+// copyAt copies src into dst at offset, skipping blocks of zeros so that dst stays sparse
+func copyAt(dst *os.File, offset int64, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, mib)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 && !zero(buf[:n]) {
+			if _, err := dst.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func zero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
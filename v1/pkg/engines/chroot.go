@@ -0,0 +1,475 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package engines
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/converters/disk"
+	"sigs.k8s.io/image-builder/pkg/oci"
+	"sigs.k8s.io/image-builder/pkg/partitions"
+)
+
+// Chroot configures disk images without booting them, the disk is attached to the host using a loop or
+// nbd device, its filesystems are mounted and the provisioning script is run inside a chroot
+type Chroot struct {
+}
+
+func (c Chroot) String() string {
+	return "chroot"
+}
+
+func (c Chroot) Kind() string {
+	return "chroot"
+}
+
+func (c Chroot) CanConfigure(source api.Image) bool {
+	return source.Kind() == api.DiskImageKind
+}
+
+const (
+	deviceLoop = "loop"
+	deviceNBD  = "nbd"
+)
+
+// compactCommand zero-fills free space like zeroFillCommand, fstrim is left out as it would trim the host's filesystems
+const compactCommand = "dd if=/dev/zero of=/var/tmp/zero bs=1M || true; rm -f /var/tmp/zero; sync"
+
+// Configures an image and returns the result or an error
+func (c Chroot) Configure(ctx pkg.BuildContext) (api.Image, error) {
+	engine, err := api.GetChrootEngine(ctx.Config.Engine)
+	if err != nil {
+		return nil, err
+	}
+	executor := &rootfsExecutor{}
+	if err := addKonfigadm(ctx, executor); err != nil {
+		return nil, err
+	}
+	if err := ctx.Execute(executor); err != nil {
+		return nil, err
+	}
+	input := ctx.Input.(api.DiskImage)
+	if input.Compact {
+		executor.script = append(executor.script, compactCommand)
+	}
+
+	image, err := Qemu{}.clone(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.DryRun {
+		fmt.Println(executor.Script())
+		return api.DiskImage{URL: image}, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("the chroot engine must be run as root")
+	}
+
+	d, err := attachDisk(ctx, image, engine.Device)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close() // nolint: errcheck
+	root, err := d.mountRoot(engine.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.mountFstab(root); err != nil {
+		return nil, err
+	}
+	executor.root = root
+	if err := executor.Run(ctx, "chroot"); err != nil {
+		return nil, fmt.Errorf("failed to configure %s: %v", image, err)
+	}
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+
+	if input.Compact {
+		if err := compact(ctx, image); err != nil {
+			return nil, err
+		}
+	} else if input.Overlay == OverlayFlatten {
+		if err := flatten(ctx, image); err != nil {
+			return nil, err
+		}
+	}
+	return api.DiskImage{
+		URL: image,
+	}, nil
+}
+
+// attachedDisk is a disk image attached to a block device, along with the filesystems mounted from it
+type attachedDisk struct {
+	ctx        pkg.BuildContext
+	device     string
+	kind       string
+	partitions []partition
+	mounts     []string
+	dir        string
+	// loops are the loop devices attached to each partition, when the kernel does not create partition devices
+	loops []string
+}
+
+// partition is a partition of an attached disk, or the whole disk if it is not partitioned
+type partition struct {
+	number int
+	device string
+	// attributes reported by blkid, e.g. TYPE, UUID, LABEL and PARTUUID
+	attrs map[string]string
+}
+
+// attachDisk attaches image to a loop device if it is raw, or an nbd device if it is qcow2
+func attachDisk(ctx pkg.BuildContext, image, kind string) (*attachedDisk, error) {
+	format, err := disk.Detect(image)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "" {
+		kind = deviceLoop
+		if format != disk.Raw {
+			kind = deviceNBD
+		}
+	}
+	d := &attachedDisk{ctx: ctx, kind: kind}
+	switch kind {
+	case deviceLoop:
+		if format != disk.Raw {
+			return nil, fmt.Errorf("%s images cannot be attached to a loop device, use the nbd device instead", format)
+		}
+		if d.device, err = output("losetup", "--find", "--show", "--partscan", image); err != nil {
+			return nil, err
+		}
+	case deviceNBD:
+		if format != disk.Raw && format != disk.QCOW2 {
+			return nil, fmt.Errorf("%s images are not supported", format)
+		}
+		if d.device, err = connectNBD(ctx, image, format); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid device %s, must be either %s or %s", kind, deviceLoop, deviceNBD)
+	}
+	logger.Infof("Attached %s to %s", image, d.device)
+
+	// nbd partitions are scanned asynchronously, so wait for them to appear
+	for i := 0; i < 50; i++ {
+		if d.partitions, err = d.scan(); err != nil || len(d.partitions) > 0 || kind == deviceLoop {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err == nil && len(d.partitions) == 0 && kind == deviceLoop {
+		err = d.attachPartitions(image)
+	}
+	if err != nil {
+		d.Close() // nolint: errcheck
+		return nil, err
+	}
+	return d, nil
+}
+
+// attachPartitions attaches each partition of a raw image to its own loop device, for when partition devices
+// are not created by the kernel, e.g. inside containers
+func (d *attachedDisk) attachPartitions(image string) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	parts, err := partitions.Read(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		device, err := output("losetup", "--find", "--show", "--offset", strconv.FormatInt(part.Start, 10),
+			"--sizelimit", strconv.FormatInt(part.Size, 10), image)
+		if err != nil {
+			return err
+		}
+		d.loops = append(d.loops, device)
+		logger.Debugf("Attached partition %d to %s", part.Number, device)
+		d.partitions = append(d.partitions, partition{number: part.Number, device: device, attrs: blkid(device)})
+	}
+	return nil
+}
+
+// connectNBD connects image to the first free nbd device, loading the nbd module if needed
+func connectNBD(ctx pkg.BuildContext, image string, format disk.Format) (string, error) {
+	if _, err := os.Stat("/sys/block/nbd0"); os.IsNotExist(err) {
+		if err := ctx.GetBinary("modprobe")("nbd max_part=16"); err != nil {
+			return "", fmt.Errorf("failed to load the nbd module: %v", err)
+		}
+	}
+	for i := 0; ; i++ {
+		dev := fmt.Sprintf("/sys/block/nbd%d", i)
+		if _, err := os.Stat(dev); err != nil {
+			break
+		}
+		// devices in use have a pid
+		if _, err := os.Stat(path.Join(dev, "pid")); err == nil {
+			continue
+		}
+		device := "/dev/" + path.Base(dev)
+		if err := ctx.GetBinary("qemu-nbd")("--connect=%s --format=%s %s", device, format, image); err != nil {
+			return "", err
+		}
+		return device, nil
+	}
+	return "", fmt.Errorf("no free nbd device found")
+}
+
+// scan returns the partitions of the disk, or the disk itself if it contains a filesystem but no partition table
+func (d *attachedDisk) scan() ([]partition, error) {
+	devices, err := filepath.Glob(d.device + "p[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(devices, func(i, j int) bool { return partitionNumber(devices[i]) < partitionNumber(devices[j]) })
+	if len(devices) == 0 {
+		devices = []string{d.device}
+	}
+	var partitions []partition
+	for _, device := range devices {
+		attrs := blkid(device)
+		if device == d.device && attrs["TYPE"] == "" {
+			return nil, nil
+		}
+		partitions = append(partitions, partition{number: partitionNumber(device), device: device, attrs: attrs})
+	}
+	return partitions, nil
+}
+
+// partitionNumber returns the number of a partition device such as /dev/loop0p2
+func partitionNumber(device string) int {
+	var n int
+	fmt.Sscanf(device[strings.LastIndex(device, "p")+1:], "%d", &n) // nolint: errcheck
+	return n
+}
+
+// blkid returns the attributes of the filesystem on device, if any
+func blkid(device string) map[string]string {
+	attrs := make(map[string]string)
+	out, err := output("blkid", "-p", "-o", "export", device)
+	if err != nil {
+		return attrs
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			attrs[parts[0]] = parts[1]
+		}
+	}
+	return attrs
+}
+
+// mount mounts device on target, recording it so that it is unmounted on Close
+func (d *attachedDisk) mount(device, target string) error {
+	if err := d.ctx.GetBinary("mount")("%s %s", device, target); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", device, err)
+	}
+	d.mounts = append(d.mounts, target)
+	return nil
+}
+
+// unmount unmounts the most recent mount
+func (d *attachedDisk) unmount() error {
+	target := d.mounts[len(d.mounts)-1]
+	if err := d.ctx.GetBinary("umount")("%s", target); err != nil {
+		return fmt.Errorf("failed to unmount %s: %v", target, err)
+	}
+	d.mounts = d.mounts[:len(d.mounts)-1]
+	return nil
+}
+
+// mountRoot mounts the root partition in a temporary directory, if number is 0 each partition is tried
+// until one is found containing /etc/os-release
+func (d *attachedDisk) mountRoot(number int) (string, error) {
+	dir, err := ioutil.TempDir("", "image-builder-chroot")
+	if err != nil {
+		return "", err
+	}
+	d.dir = dir
+	for _, part := range d.partitions {
+		if number > 0 && part.number != number {
+			continue
+		}
+		switch part.attrs["TYPE"] {
+		case "", "swap", "vfat":
+			if number == 0 {
+				continue
+			}
+		}
+		if err := d.mount(part.device, dir); err != nil {
+			return "", err
+		}
+		if number > 0 {
+			return dir, nil
+		}
+		if _, err := os.Lstat(path.Join(dir, "etc/os-release")); err == nil {
+			logger.Infof("Found root filesystem on %s", part.device)
+			return dir, nil
+		}
+		if err := d.unmount(); err != nil {
+			return "", err
+		}
+	}
+	if number > 0 {
+		return "", fmt.Errorf("partition %d not found on %s", number, d.device)
+	}
+	return "", fmt.Errorf("no root filesystem found on %s", d.device)
+}
+
+// mountFstab mounts the filesystems in the fstab of root that are on the same disk, e.g. /boot and /boot/efi
+func (d *attachedDisk) mountFstab(root string) error {
+	f, err := os.Open(path.Join(root, "etc/fstab"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	type entry struct {
+		device, dir string
+		nofail      bool
+	}
+	var entries []entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		dir := path.Clean(fields[1])
+		options := ""
+		if len(fields) > 3 {
+			options = "," + fields[3] + ","
+		}
+		if dir == "/" || !strings.HasPrefix(dir, "/") || fields[2] == "swap" || strings.Contains(options, ",noauto,") {
+			continue
+		}
+		if device := d.find(fields[0]); device != "" {
+			entries = append(entries, entry{device, dir, strings.Contains(options, ",nofail,")})
+		} else {
+			logger.Debugf("Skipping %s, %s is not on the disk", dir, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// parents are mounted before their children
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strings.Count(entries[i].dir, "/") < strings.Count(entries[j].dir, "/")
+	})
+	for _, e := range entries {
+		target, err := oci.SafePath(root, e.dir)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+			logger.Warnf("Not mounting %s, it is not a directory", e.dir)
+			continue
+		}
+		if err := d.mount(e.device, target); err != nil && e.nofail {
+			logger.Warnf("Not mounting %s: %v", e.dir, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the partition matching an fstab device specification such as UUID=... or /dev/disk/by-label/...
+func (d *attachedDisk) find(spec string) string {
+	key, value := "", ""
+	for _, attr := range []string{"UUID", "LABEL", "PARTUUID", "PARTLABEL"} {
+		if strings.HasPrefix(spec, attr+"=") {
+			key, value = attr, strings.Trim(strings.TrimPrefix(spec, attr+"="), `"`)
+		} else if strings.HasPrefix(spec, "/dev/disk/by-"+strings.ToLower(attr)+"/") {
+			key, value = attr, path.Base(spec)
+		}
+	}
+	if key == "" {
+		return ""
+	}
+	for _, part := range d.partitions {
+		if strings.EqualFold(part.attrs[key], value) {
+			return part.device
+		}
+	}
+	return ""
+}
+
+// Close unmounts every filesystem and detaches the disk, it is safe to call more than once
+func (d *attachedDisk) Close() error {
+	for len(d.mounts) > 0 {
+		if err := d.unmount(); err != nil {
+			return err
+		}
+	}
+	if d.dir != "" {
+		os.Remove(d.dir) // nolint: errcheck
+		d.dir = ""
+	}
+	for len(d.loops) > 0 {
+		device := d.loops[len(d.loops)-1]
+		if err := d.ctx.GetBinary("losetup")("-d %s", device); err != nil {
+			return fmt.Errorf("failed to detach %s: %v", device, err)
+		}
+		d.loops = d.loops[:len(d.loops)-1]
+	}
+	if d.device == "" {
+		return nil
+	}
+	var err error
+	if d.kind == deviceNBD {
+		err = d.ctx.GetBinary("qemu-nbd")("--disconnect %s", d.device)
+	} else {
+		err = d.ctx.GetBinary("losetup")("-d %s", d.device)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to detach %s: %v", d.device, err)
+	}
+	d.device = ""
+	return nil
+}
+
+// output runs a command and returns its trimmed output
+func output(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(string(exit.Stderr)))
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
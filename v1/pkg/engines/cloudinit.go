@@ -20,44 +20,74 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
 
-	"github.com/flanksource/commons/deps"
+	"github.com/flanksource/commons/utils"
+	"gopkg.in/yaml.v2"
+
+	"sigs.k8s.io/image-builder/pkg/fat"
 )
 
-var mkisofs = deps.Binary("mkisofs", "", "")
+// seedSize is large enough for any user-data, the smallest FAT32 filesystem is ~33MB
+const seedSize = 40 * 1024 * 1024
 
-//createCloudInitISO creates a new ISO with the user/meta data and returns a path to the iso
-func createCloudInitISO(hostname string, userData string) (string, error) {
-	dir, err := ioutil.TempDir("", "cloudinit")
-	cwd, _ := os.Getwd()
-	defer os.Chdir(cwd)
-	if err := os.Chdir(dir); err != nil {
-		return "", fmt.Errorf("Failed to chdir %v", err)
-	}
-	if err != nil {
-		return "", fmt.Errorf("Failed to create temp dir %s", err)
+// NoCloudSeed is the user-data and metadata read by the cloud-init NoCloud datasource
+type NoCloudSeed struct {
+	// InstanceID defaults to a random id, so that cloud-init always treats the VM as a new instance
+	InstanceID    string
+	Hostname      string
+	UserData      string
+	VendorData    string
+	NetworkConfig string
+}
+
+// newNoCloudSeed returns a seed for userData with the network-config and vendor-data configured on the engine
+func newNoCloudSeed(vm *qemuVM, userData string) (NoCloudSeed, error) {
+	seed := NoCloudSeed{Hostname: "builder", UserData: userData}
+	if vm.NetworkConfig != nil {
+		data, err := yaml.Marshal(vm.NetworkConfig)
+		if err != nil {
+			return seed, fmt.Errorf("invalid network_config: %v", err)
+		}
+		seed.NetworkConfig = string(data)
 	}
-	if err := ioutil.WriteFile(path.Join(dir, "user-data"), []byte(userData), 0644); err != nil {
-		return "", fmt.Errorf("Failed to save user-data %s", err)
+	switch vendorData := vm.VendorData.(type) {
+	case nil:
+	case string:
+		seed.VendorData = vendorData
+	default:
+		data, err := yaml.Marshal(vendorData)
+		if err != nil {
+			return seed, fmt.Errorf("invalid vendor_data: %v", err)
+		}
+		seed.VendorData = "#cloud-config\n" + string(data)
 	}
+	return seed, nil
+}
 
-	isoFilename, err := ioutil.TempFile("", "user-data*.iso")
-	if err != nil {
-		return "", fmt.Errorf("Failed to create temp iso %s", err)
+// Create writes the seed to a new vfat image labelled cidata and returns its path
+func (seed NoCloudSeed) Create() (string, error) {
+	if seed.InstanceID == "" {
+		seed.InstanceID = "image-builder-" + utils.RandomString(8)
 	}
-
-	metadata := fmt.Sprintf("instance-id: \nlocal-hostname: %s", hostname)
-	if err := ioutil.WriteFile(path.Join(dir, "meta-data"), []byte(metadata), 0644); err != nil {
-		return "", fmt.Errorf("Failed to write metadata %v", err)
+	files := map[string][]byte{
+		"user-data": []byte(seed.UserData),
+		"meta-data": []byte(fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", seed.InstanceID, seed.Hostname)),
+	}
+	if seed.VendorData != "" {
+		files["vendor-data"] = []byte(seed.VendorData)
+	}
+	if seed.NetworkConfig != "" {
+		files["network-config"] = []byte(seed.NetworkConfig)
 	}
 
-	if err := mkisofs("-output %s -volid cidata -joliet -rock user-data meta-data 2>&1", isoFilename.Name()); err != nil {
-		return "", err
+	tmp, err := ioutil.TempFile("", "cidata*.img")
+	if err != nil {
+		return "", fmt.Errorf("failed to create seed: %v", err)
 	}
-	info, _ := isoFilename.Stat()
-	if info.Size() == 0 {
-		return "", fmt.Errorf("Empty iso created")
+	tmp.Close()
+	if err := fat.Create(tmp.Name(), seedSize, "cidata", files); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to create seed: %v", err)
 	}
-	return isoFilename.Name(), nil
+	return tmp.Name(), nil
 }
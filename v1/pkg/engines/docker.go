@@ -17,15 +17,22 @@
 package engines
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
-	"github.com/flanksource/commons/utils"
+	"github.com/flanksource/commons/files"
+	"github.com/flanksource/commons/logger"
 	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/api/executors"
 	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/oci"
 )
 
 type Docker struct {
@@ -42,44 +49,191 @@ func (d Docker) CanConfigure(source api.Image) bool {
 // Configures an image and returns the result or an error
 func (d Docker) Configure(ctx pkg.BuildContext) (api.Image, error) {
 	docker := ctx.GetBinary("docker")
-	dockerfile := ""
-	bash, err := ctx.Config.Konfigadm.ToBash()
+	engine, err := api.GetDockerEngine(ctx.Config.Engine)
 	if err != nil {
 		return nil, err
 	}
+	dir, err := ioutil.TempDir("", "image-builder-docker")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	dockerfile := &dockerfile{dir: dir}
+	if err := addKonfigadm(ctx, dockerfile); err != nil {
+		return nil, err
+	}
+	if err := ctx.Execute(dockerfile); err != nil {
+		return nil, err
+	}
 	dockerImage := ctx.Input.(api.DockerImage)
-	dockerfile += fmt.Sprintf("FROM %s:%s\n", dockerImage.Image, dockerImage.Tag)
-	for _, cmd := range strings.Split(bash, "\n") {
-		if strings.TrimSpace(cmd) == "" {
-			continue
-		}
-		dockerfile += fmt.Sprintf("RUN %s\n", cmd)
+	dockerfile.from = fmt.Sprintf("%s:%s", dockerImage.Image, dockerImage.Tag)
+	if err := dockerfile.Write(); err != nil {
+		return nil, err
 	}
 	if ctx.DryRun {
 		fmt.Println(dockerfile)
 		return api.DockerImage{}, nil
 	}
-	tmp := fmt.Sprintf("Dockerfile.image-builder")
-	defer os.Remove(tmp)
 
-	out := dockerImage.Image + "-" + utils.ShortTimestamp()
+	tag, err := dockerfile.Digest()
+	if err != nil {
+		return nil, err
+	}
+	out := api.DockerImage{
+		Image: dockerImage.Image + "-image-builder",
+		Tag:   tag[:12],
+	}
+	if len(engine.Platforms) > 0 {
+		return buildx(ctx, dir, out, engine.Platforms)
+	}
+	if err := docker("build %s -f %s -t %s", dir, path.Join(dir, "Dockerfile"), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
-	if err := ioutil.WriteFile(tmp, []byte(dockerfile), 0644); err != nil {
+// buildx builds the image for each platform using docker buildx, multi-platform images cannot be loaded
+// into the docker daemon so they are exported as an OCI image layout and the digest of each platform recorded
+func buildx(ctx pkg.BuildContext, dir string, out api.DockerImage, platforms []string) (api.Image, error) {
+	out.Archive = strings.NewReplacer("/", "-", ":", "-").Replace(out.String()) + ".tar"
+	logger.Infof("Building %s for %s", out, strings.Join(platforms, ", "))
+	if err := ctx.GetBinary("docker")("buildx build --platform %s --output type=oci,dest=%s -f %s -t %s %s",
+		strings.Join(platforms, ","), out.Archive, path.Join(dir, "Dockerfile"), out, dir); err != nil {
+		return nil, err
+	}
+	archive, err := oci.OpenArchive(out.Archive)
+	if err != nil {
 		return nil, err
 	}
-	if err := docker(fmt.Sprintf("build ./ -f %s -t %s", tmp, out)); err != nil {
+	defer archive.Close()
+	manifests, err := archive.Manifests()
+	if err != nil {
 		return nil, err
 	}
-	return api.DockerImage{
-		Image: out,
-		Tag:   "latest",
-	}, nil
+	out.Digests = make(map[string]string)
+	for _, manifest := range manifests {
+		// attestations are stored as manifests with an unknown platform
+		if manifest.Platform == nil || manifest.Platform.OS == "unknown" {
+			continue
+		}
+		out.Digests[manifest.Platform.String()] = manifest.Digest
+		logger.Infof("%s: %s", manifest.Platform, manifest.Digest)
+	}
+	return out, nil
+}
+
+// addKonfigadm adds the files and commands generated by konfigadm to executor, files are added in order
+// so that the same config always produces the same result
+func addKonfigadm(ctx pkg.BuildContext, executor api.Executor) error {
+	fs, commands, err := ctx.Config.Konfigadm.ApplyPhases()
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for path := range fs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		file := fs[path]
+		if err := executor.AddFile(path, strings.NewReader(file.Content)); err != nil {
+			return err
+		}
+		if file.Permissions != "" {
+			if err := executor.AddCommand(fmt.Sprintf("chmod %s %s", file.Permissions, path)); err != nil {
+				return err
+			}
+		}
+		if file.Owner != "" {
+			if err := executor.AddCommand(fmt.Sprintf("chown %s %s", file.Owner, path)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, cmd := range commands {
+		if err := executor.AddCommand(cmd.Cmd); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (d Docker) AddFile(path string, contents io.Reader) error {
+// dockerFiles is where the files directory of the build context is copied to in the image, along with the
+// provisioning script it is removed after the script is run
+const dockerFiles = "/tmp/image-builder/files"
+
+// dockerfile translates provisioning steps into a Dockerfile with a single COPY instruction for all files and a
+// single RUN instruction that moves the files into place and runs all commands, so that multi-line commands work
+// and the number of layers does not depend on the number of files. Files are staged in dir which is used as the
+// build context.
+type dockerfile struct {
+	dir  string
+	from string
+	// installs moves each staged file to its destination before the commands are run
+	installs []string
+	script   []string
+}
+
+func (d *dockerfile) String() string {
+	lines := []string{"FROM " + d.from}
+	if len(d.installs) > 0 || len(d.script) > 0 {
+		script := path.Join(dockerFiles, "provision.sh")
+		lines = append(lines,
+			"COPY files/ "+dockerFiles+"/",
+			fmt.Sprintf("RUN if command -v bash > /dev/null; then bash -ex %[1]s; else sh -ex %[1]s; fi && rm -rf %[2]s",
+				script, path.Dir(dockerFiles)))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (d *dockerfile) AddFile(dst string, contents io.Reader) error {
+	name := fmt.Sprintf("%d-%s", len(d.installs), path.Base(dst))
+	if _, err := files.CopyFromReader(contents, path.Join(d.dir, "files", name), 0644); err != nil {
+		return err
+	}
+	d.installs = append(d.installs, fmt.Sprintf("mkdir -p %s && mv %s %s",
+		executors.Quote(path.Dir(dst)), executors.Quote(path.Join(dockerFiles, name)), executors.Quote(dst)))
 	return nil
 }
 
-func (d Docker) AddCommand(command ...string) error {
+func (d *dockerfile) AddCommand(command ...string) error {
+	for _, cmd := range command {
+		if strings.TrimSpace(cmd) == "" {
+			continue
+		}
+		d.script = append(d.script, cmd)
+	}
 	return nil
 }
+
+// Write saves the provisioning script and Dockerfile to the build context
+func (d *dockerfile) Write() error {
+	if err := os.MkdirAll(path.Join(d.dir, "files"), 0755); err != nil {
+		return err
+	}
+	script := strings.Join(append(append([]string{}, d.installs...), d.script...), "\n") + "\n"
+	if err := ioutil.WriteFile(path.Join(d.dir, "files", "provision.sh"), []byte(script), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(d.dir, "Dockerfile"), []byte(d.String()), 0644)
+}
+
+// Digest returns the sha256 of the build context, which only depends on the config used to generate it
+func (d *dockerfile) Digest() (string, error) {
+	hash := sha256.New()
+	err := filepath.Walk(d.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(d.dir, file)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s %d\n", filepath.ToSlash(rel), len(data))
+		hash.Write(data)
+		return nil
+	})
+	return fmt.Sprintf("%x", hash.Sum(nil)), err
+}
@@ -17,8 +17,6 @@
 package engines
 
 import (
-	"io"
-
 	"github.com/flanksource/commons/logger"
 	"sigs.k8s.io/image-builder/api"
 	"sigs.k8s.io/image-builder/pkg"
@@ -54,15 +52,3 @@ func (p Packer) Configure(ctx pkg.BuildContext) (api.Image, error) {
 	logger.Prettyf("Finished build", manifest)
 	return manifest.GetImage()
 }
-
-func (p Packer) AddFile(path string, contents io.Reader) error {
-	return nil
-}
-
-func (p Packer) AddAnsiblePlaybook(path string) error {
-	return nil
-}
-
-func (p Packer) AddCommand(command ...string) error {
-	return nil
-}
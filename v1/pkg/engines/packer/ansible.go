@@ -0,0 +1,149 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/image-builder/api"
+)
+
+// ansibleDefaults are the variables required by the CAPI playbooks, these mirror images/capi/packer/config
+var ansibleDefaults = map[string]interface{}{
+	"containerd_version":              defaultContainerdVersion,
+	"containerd_sha256":               "757efb93a4f3161efc447a943317503d8a7ded5cb4cc0cba3f3318d7ce1542ed",
+	"containerd_pause_image":          "k8s.gcr.io/pause:3.2",
+	"crictl_version":                  "1.16.1",
+	"crictl_sha256":                   "19fed421710fccfe58f5573383bb137c19438a9056355556f1a15da8d23b3ad1",
+	"crictl_source_type":              "pkg",
+	"custom_role":                     false,
+	"custom_role_names":               "",
+	"disable_public_repos":            false,
+	"extra_debs":                      "",
+	"extra_repos":                     "",
+	"extra_rpms":                      "",
+	"http_proxy":                      "",
+	"https_proxy":                     "",
+	"no_proxy":                        "",
+	"kubeadm_template":                "etc/kubeadm.yml",
+	"kubernetes_cni_semver":           "v0.8.7",
+	"kubernetes_cni_rpm_version":      "0.8.7-0",
+	"kubernetes_cni_deb_version":      "0.8.7-00",
+	"kubernetes_cni_source_type":      "pkg",
+	"kubernetes_cni_http_source":      "https://github.com/containernetworking/plugins/releases/download",
+	"kubernetes_cni_http_checksum":    "sha256:https://storage.googleapis.com/k8s-artifacts-cni/release/v0.8.7/cni-plugins-linux-amd64-v0.8.7.tgz.sha256",
+	"kubernetes_semver":               "v1.17.11",
+	"kubernetes_source_type":          "pkg",
+	"kubernetes_http_source":          "https://storage.googleapis.com/kubernetes-release/release",
+	"kubernetes_rpm_repo":             "https://packages.cloud.google.com/yum/repos/kubernetes-el7-x86_64",
+	"kubernetes_rpm_gpg_key":          "https://packages.cloud.google.com/yum/doc/yum-key.gpg https://packages.cloud.google.com/yum/doc/rpm-package-key.gpg",
+	"kubernetes_rpm_gpg_check":        true,
+	"kubernetes_deb_repo":             "https://apt.kubernetes.io/ kubernetes-xenial",
+	"kubernetes_deb_gpg_key":          "https://packages.cloud.google.com/apt/doc/apt-key.gpg",
+	"kubernetes_container_registry":   "k8s.gcr.io",
+	"kubernetes_load_additional_imgs": false,
+	"redhat_epel_rpm":                 "https://dl.fedoraproject.org/pub/epel/epel-release-latest-7.noarch.rpm",
+	"reenable_public_repos":           true,
+	"remove_extra_repos":              false,
+}
+
+const defaultContainerdVersion = "1.4.1"
+
+// AnsibleVars derives the variables for the CAPI playbooks from the kubernetes and
+// container_runtime sections of the config, overrides take precedence over derived values.
+func AnsibleVars(config api.KubernetesConfiguration, overrides map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	for k, v := range ansibleDefaults {
+		vars[k] = v
+	}
+
+	version := config.Version
+	if config.Konfigadm.Kubernetes != nil && config.Konfigadm.Kubernetes.Version != "" {
+		version = config.Konfigadm.Kubernetes.Version
+	}
+	if version != "" {
+		version = strings.TrimPrefix(version, "v")
+		vars["kubernetes_semver"] = "v" + version
+		vars["kubernetes_deb_version"] = version + "-00"
+		vars["kubernetes_rpm_version"] = version + "-0"
+	}
+
+	runtime := config.Konfigadm.ContainerRuntime
+	if runtime.Type != "" && runtime.Type != "containerd" {
+		return nil, fmt.Errorf("the CAPI playbooks only support containerd, not %s", runtime.Type)
+	}
+	if runtime.Version != "" && runtime.Version != defaultContainerdVersion {
+		vars["containerd_version"] = runtime.Version
+		if _, ok := overrides["containerd_sha256"]; !ok {
+			return nil, fmt.Errorf("containerd %s requires containerd_sha256 to be specified in ansible_vars", runtime.Version)
+		}
+	}
+
+	for _, proxy := range []string{"http_proxy", "https_proxy", "no_proxy"} {
+		for k, v := range config.Konfigadm.Environment {
+			if strings.ToLower(k) == proxy {
+				vars[proxy] = v
+			}
+		}
+	}
+
+	for k, v := range overrides {
+		vars[k] = v
+	}
+
+	if _, ok := vars["kubernetes_series"]; !ok {
+		series, err := kubernetesSeries(fmt.Sprintf("%v", vars["kubernetes_semver"]))
+		if err != nil {
+			return nil, err
+		}
+		vars["kubernetes_series"] = series
+	}
+	if _, ok := vars["kubernetes_deb_version"]; !ok {
+		vars["kubernetes_deb_version"] = strings.TrimPrefix(fmt.Sprintf("%v", vars["kubernetes_semver"]), "v") + "-00"
+	}
+	if _, ok := vars["kubernetes_rpm_version"]; !ok {
+		vars["kubernetes_rpm_version"] = strings.TrimPrefix(fmt.Sprintf("%v", vars["kubernetes_semver"]), "v") + "-0"
+	}
+	if _, ok := vars["containerd_url"]; !ok {
+		containerd := vars["containerd_version"]
+		vars["containerd_url"] = fmt.Sprintf("https://github.com/containerd/containerd/releases/download/v%s/cri-containerd-cni-%s-linux-amd64.tar.gz", containerd, containerd)
+	}
+	if _, ok := vars["crictl_url"]; !ok {
+		crictl := vars["crictl_version"]
+		vars["crictl_url"] = fmt.Sprintf("https://github.com/kubernetes-sigs/cri-tools/releases/download/v%s/crictl-v%s-linux-amd64.tar.gz", crictl, crictl)
+	}
+	return vars, nil
+}
+
+// kubernetesSeries returns the vMAJOR.MINOR series of a vMAJOR.MINOR.PATCH version, which selects the package repository
+func kubernetesSeries(semver string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(semver, "v"), ".")
+	if len(parts) == 3 {
+		valid := true
+		for _, part := range parts {
+			if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+				valid = false
+			}
+		}
+		if valid {
+			return fmt.Sprintf("v%s.%s", parts[0], parts[1]), nil
+		}
+	}
+	return "", fmt.Errorf("invalid kubernetes version %s, must be a full version such as v1.18.6 or kubernetes_series must be specified in ansible_vars", semver)
+}
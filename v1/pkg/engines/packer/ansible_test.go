@@ -0,0 +1,59 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package packer
+
+import (
+	"testing"
+
+	"sigs.k8s.io/image-builder/api"
+)
+
+func TestAnsibleVarsKubernetesSeries(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		overrides map[string]interface{}
+		series    string
+		err       bool
+	}{
+		{name: "default", series: "v1.17"},
+		{name: "prefixed", version: "v1.18.6", series: "v1.18"},
+		{name: "unprefixed", version: "1.18.6", series: "v1.18"},
+		{name: "minor only", version: "v1.18", err: true},
+		{name: "non numeric", version: "v1.18.x", err: true},
+		{name: "semver override", overrides: map[string]interface{}{"kubernetes_semver": "v1.19.2"}, series: "v1.19"},
+		{name: "invalid semver override", overrides: map[string]interface{}{"kubernetes_semver": "latest"}, err: true},
+		{name: "series override", version: "v1.18", overrides: map[string]interface{}{"kubernetes_series": "v1.18"}, series: "v1.18"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vars, err := AnsibleVars(api.KubernetesConfiguration{Version: test.version}, test.overrides)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got kubernetes_series %v", vars["kubernetes_series"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vars["kubernetes_series"] != test.series {
+				t.Errorf("expected kubernetes_series %s, got %v", test.series, vars["kubernetes_series"])
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatJSON = "json"
+	FormatHCL  = "hcl"
+)
+
+// hclBlocks are builder options that are nested blocks rather than map attributes in HCL2
+var hclBlocks = map[string]bool{
+	"ami_block_device_mappings":    true,
+	"assume_role":                  true,
+	"launch_block_device_mappings": true,
+	"security_group_filter":        true,
+	"shared_image_gallery":         true,
+	"source_ami_filter":            true,
+	"subnet_filter":                true,
+	"vpc_filter":                   true,
+}
+
+var (
+	hclIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+	// legacy template functions that have an HCL2 equivalent
+	legacyFunction = regexp.MustCompile("{{\\s*(env|user)\\s+`([^`]+)`\\s*}}")
+)
+
+// defaultFormat returns hcl for packer versions that support HCL2 templates without warnings (>= 1.7.0)
+func defaultFormat(version string) string {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	if major > 1 || (major == 1 && minor >= 7) {
+		return FormatHCL
+	}
+	return FormatJSON
+}
+
+// hclWriter renders packer templates as HCL2, legacy {{env}} and {{user}} functions are
+// replaced with variables so that the same builder options can be used with either format.
+type hclWriter struct {
+	buf       bytes.Buffer
+	variables map[string]interface{}
+}
+
+// HCL renders the template as HCL2 with a source block per builder and a single build block
+func (packer *Packer) HCL() ([]byte, error) {
+	w := &hclWriter{variables: make(map[string]interface{})}
+	for k, v := range packer.Variables {
+		w.variables[k] = v
+	}
+
+	var sources []string
+	for _, builder := range packer.Builders {
+		opts, err := toMap(builder)
+		if err != nil {
+			return nil, err
+		}
+		kind := fmt.Sprintf("%v", opts["type"])
+		name := kind
+		if n, ok := opts["name"]; ok {
+			name = fmt.Sprintf("%v", n)
+		}
+		delete(opts, "type")
+		delete(opts, "name")
+		sources = append(sources, fmt.Sprintf("source.%s.%s", kind, name))
+		fmt.Fprintf(&w.buf, "source %s %s {\n", w.quote(kind), w.quote(name))
+		w.body(opts, 1)
+		w.buf.WriteString("}\n\n")
+	}
+
+	fmt.Fprintf(&w.buf, "build {\n")
+	w.attribute("sources", toInterfaces(sources), 1)
+	for _, provisioner := range packer.Provisioners {
+		if err := w.typedBlock("provisioner", provisioner); err != nil {
+			return nil, err
+		}
+	}
+	for _, postProcessor := range packer.PostProcessors {
+		if err := w.typedBlock("post-processor", postProcessor); err != nil {
+			return nil, err
+		}
+	}
+	w.buf.WriteString("}\n")
+
+	// variables are collected while rendering, so they are written last and prepended
+	var out bytes.Buffer
+	for _, name := range sortedKeys(w.variables) {
+		fmt.Fprintf(&out, "variable %s {\n", w.quote(name))
+		if env, ok := w.variables[name].(envDefault); ok {
+			fmt.Fprintf(&out, "  default = env(%s)\n", w.quote(string(env)))
+		} else if w.variables[name] != nil {
+			out.WriteString("  default = ")
+			w.value(&out, w.variables[name], 1)
+			out.WriteString("\n")
+		}
+		out.WriteString("}\n\n")
+	}
+	out.Write(w.buf.Bytes())
+	return out.Bytes(), nil
+}
+
+// envDefault is a variable whose default is read from the environment
+type envDefault string
+
+func (w *hclWriter) typedBlock(name string, block interface{}) error {
+	opts, err := toMap(block)
+	if err != nil {
+		return err
+	}
+	kind := fmt.Sprintf("%v", opts["type"])
+	delete(opts, "type")
+	fmt.Fprintf(&w.buf, "\n  %s %s {\n", name, w.quote(kind))
+	w.body(opts, 2)
+	w.buf.WriteString("  }\n")
+	return nil
+}
+
+func (w *hclWriter) body(opts map[string]interface{}, indent int) {
+	for _, key := range sortedKeys(opts) {
+		value := opts[key]
+		switch v := value.(type) {
+		case nil:
+			continue
+		case map[string]interface{}:
+			if hclBlocks[key] || !isFlat(v) {
+				w.block(key, v, indent)
+				continue
+			}
+		case []interface{}:
+			if len(v) > 0 && allMaps(v) {
+				for _, item := range v {
+					w.block(key, item.(map[string]interface{}), indent)
+				}
+				continue
+			}
+		}
+		w.attribute(key, value, indent)
+	}
+}
+
+func (w *hclWriter) block(name string, body map[string]interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	fmt.Fprintf(&w.buf, "%s%s {\n", pad, name)
+	w.body(body, indent+1)
+	fmt.Fprintf(&w.buf, "%s}\n", pad)
+}
+
+func (w *hclWriter) attribute(name string, value interface{}, indent int) {
+	fmt.Fprintf(&w.buf, "%s%s = ", strings.Repeat("  ", indent), name)
+	w.value(&w.buf, value, indent)
+	w.buf.WriteString("\n")
+}
+
+func (w *hclWriter) value(buf *bytes.Buffer, value interface{}, indent int) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case string:
+		buf.WriteString(w.template(v))
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case int, int64, uint64:
+		fmt.Fprintf(buf, "%d", v)
+	case []interface{}:
+		buf.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			w.value(buf, item, indent)
+		}
+		buf.WriteString("]")
+	case map[string]interface{}:
+		pad := strings.Repeat("  ", indent)
+		buf.WriteString("{\n")
+		for _, key := range sortedKeys(v) {
+			k := key
+			if !hclIdentifier.MatchString(k) {
+				k = w.quote(k)
+			}
+			fmt.Fprintf(buf, "%s  %s = ", pad, k)
+			w.value(buf, v[key], indent+1)
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(buf, "%s}", pad)
+	default:
+		buf.WriteString(w.quote(fmt.Sprintf("%v", v)))
+	}
+}
+
+// template quotes s, replacing legacy {{env}} and {{user}} functions with variable references
+func (w *hclWriter) template(s string) string {
+	var out strings.Builder
+	out.WriteString(`"`)
+	last := 0
+	for _, match := range legacyFunction.FindAllStringSubmatchIndex(s, -1) {
+		out.WriteString(escape(s[last:match[0]]))
+		fn, arg := s[match[2]:match[3]], s[match[4]:match[5]]
+		name := arg
+		if fn == "env" {
+			name = "env_" + strings.ToLower(arg)
+			w.variables[name] = envDefault(arg)
+		} else if _, ok := w.variables[name]; !ok {
+			w.variables[name] = nil
+		}
+		fmt.Fprintf(&out, "${var.%s}", name)
+		last = match[1]
+	}
+	out.WriteString(escape(s[last:]))
+	out.WriteString(`"`)
+	return out.String()
+}
+
+func (w *hclWriter) quote(s string) string {
+	return `"` + escape(s) + `"`
+}
+
+// escape escapes s for use inside an HCL2 string literal, without interpolation
+func escape(s string) string {
+	data, _ := json.Marshal(s)
+	quoted := string(data[1 : len(data)-1])
+	// json escapes <, > and & for html which HCL does not understand
+	quoted = strings.NewReplacer(`\u003c`, "<", `\u003e`, ">", `\u0026`, "&").Replace(quoted)
+	return strings.NewReplacer("${", "$${", "%{", "%%{").Replace(quoted)
+}
+
+// toMap converts a builder, provisioner or post-processor into a generic map
+func toMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func isFlat(m map[string]interface{}) bool {
+	for _, v := range m {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+func allMaps(list []interface{}) bool {
+	for _, item := range list {
+		if _, ok := item.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toInterfaces(list []string) []interface{} {
+	var out []interface{}
+	for _, s := range list {
+		out = append(out, s)
+	}
+	return out
+}
+
+// templateFile returns the name of the file the template is written to, packer detects the format using the extension
+func templateFile(format string) string {
+	if format == FormatHCL {
+		return "packer-image-builder.pkr.hcl"
+	}
+	return "packer-image-builder.json"
+}
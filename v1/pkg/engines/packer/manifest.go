@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/image-builder/api"
+)
+
+type Manifest struct {
+	Builds      []Build `json:"builds"`
+	LastRunUUID string  `json:"last_run_uuid"`
+}
+
+type Build struct {
+	Name          string      `json:"name"`
+	BuilderType   string      `json:"builder_type"`
+	BuildTime     int         `json:"build_time"`
+	Files         []File      `json:"files"`
+	ArtifactID    string      `json:"artifact_id"`
+	PackerRunUUID string      `json:"packer_run_uuid"`
+	CustomData    interface{} `json:"custom_data"`
+}
+
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// GetImage returns the image created by the most recent run
+func (manifest Manifest) GetImage() (api.Image, error) {
+	for _, build := range manifest.Builds {
+		if manifest.LastRunUUID != "" && build.PackerRunUUID != manifest.LastRunUUID {
+			continue
+		}
+		return build.GetImage()
+	}
+	return nil, fmt.Errorf("cannot find image type %v", manifest)
+}
+
+// GetImage maps the artifact of a builder to an image
+func (build Build) GetImage() (api.Image, error) {
+	switch build.BuilderType {
+	case "amazon-ebs":
+		// artifact ids are in the form of region:ami,region:ami
+		ami := api.AMI{Regions: make(map[string]string)}
+		for _, artifact := range strings.Split(build.ArtifactID, ",") {
+			parts := strings.SplitN(artifact, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("invalid amazon-ebs artifact: %s", build.ArtifactID)
+			}
+			ami.Regions[parts[0]] = parts[1]
+			if ami.ID == "" {
+				ami.Region = parts[0]
+				ami.ID = parts[1]
+			}
+		}
+		return ami, nil
+	case "vmware-iso", "vmware-vmx":
+		if ova := build.file(".ova"); ova != "" {
+			return api.OVA{URL: ova}, nil
+		}
+		if vmdk := build.file(".vmdk"); vmdk != "" {
+			return api.VMDK{URL: vmdk}, nil
+		}
+	case "qemu":
+		// the qemu builder produces a single disk image named after the vm
+		for _, file := range build.Files {
+			return api.DiskImage{URL: file.Name}, nil
+		}
+	case "azure-arm":
+		// the artifact is either a managed image id or the URL of a VHD
+		if strings.HasPrefix(build.ArtifactID, "http") {
+			return api.VHD{URL: build.ArtifactID}, nil
+		}
+		return api.AzureImage{ID: build.ArtifactID}, nil
+	case "googlecompute":
+		return api.GCEImage{ImageName: build.ArtifactID}, nil
+	case "digitalocean":
+		// artifact ids are in the form of region,region:snapshot
+		parts := strings.SplitN(build.ArtifactID, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid digitalocean artifact: %s", build.ArtifactID)
+		}
+		return api.DigitalOceanImage{
+			ID:      parts[1],
+			Regions: strings.Split(parts[0], ","),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported packer builder: %s", build.BuilderType)
+	}
+	return nil, fmt.Errorf("cannot find an image in the %s artifact %s: %v", build.BuilderType, build.ArtifactID, build.Files)
+}
+
+// file returns the first file with the specified extension
+func (build Build) file(ext string) string {
+	for _, file := range build.Files {
+		if strings.EqualFold(filepath.Ext(file.Name), ext) {
+			return file.Name
+		}
+	}
+	return ""
+}
@@ -20,14 +20,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/flanksource/commons/deps"
 	"github.com/flanksource/commons/files"
 	"github.com/flanksource/commons/logger"
+	konfigadm "github.com/flanksource/konfigadm/pkg/types"
 
 	"sigs.k8s.io/image-builder/api"
 	"sigs.k8s.io/image-builder/pkg"
@@ -42,32 +45,10 @@ type Packer struct {
 	Variables      map[string]interface{} `json:"variables"`
 	manifestPath   string
 	binary         deps.BinaryFunc
-}
-
-type Manifest struct {
-	Builds []struct {
-		Name          string      `json:"name"`
-		BuilderType   string      `json:"builder_type"`
-		BuildTime     int         `json:"build_time"`
-		Files         interface{} `json:"files"`
-		ArtifactID    string      `json:"artifact_id"`
-		PackerRunUUID string      `json:"packer_run_uuid"`
-		CustomData    interface{} `json:"custom_data"`
-	} `json:"builds"`
-	LastRunUUID string `json:"last_run_uuid"`
-}
-
-func (manifest Manifest) GetImage() (api.Image, error) {
-	for _, build := range manifest.Builds {
-		switch build.BuilderType {
-		case "amazon-ebs":
-			return &api.AMI{
-				Region: strings.Split(build.ArtifactID, ":")[0],
-				ID:     strings.Split(build.ArtifactID, ":")[1],
-			}, nil
-		}
-	}
-	return nil, fmt.Errorf("cannot find image type %v", manifest)
+	// dir contains files that are uploaded by file provisioners
+	dir string
+	// format is either json or hcl
+	format string
 }
 
 // type Builder interface {
@@ -84,53 +65,48 @@ func (manifest Manifest) GetImage() (api.Image, error) {
 // }
 
 type ShellProvisioner struct {
-	EnvironmentVars []string `json:"environment_vars"`
-	ExecuteCommand  string   `json:"execute_command"`
+	EnvironmentVars []string `json:"environment_vars,omitempty"`
+	ExecuteCommand  string   `json:"execute_command,omitempty"`
 	Scripts         []string `json:"inline"`
 	Type            string   `json:"type"`
 }
 
+type FileProvisioner struct {
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
 type AnsibleProvisioner struct {
-	Variables       map[string]interface{} `json:"variables"`
-	Playbook        string                 `json:"playbook"`
-	EnvironmentVars []string               `json:"environment_vars"`
-	ExecuteCommand  string                 `json:"execute_command"`
-	Scripts         []string               `json:"scripts"`
+	Variables       map[string]interface{} `json:"variables,omitempty"`
+	Playbook        string                 `json:"playbook_file"`
+	EnvironmentVars []string               `json:"ansible_env_vars,omitempty"`
+	ExecuteCommand  string                 `json:"execute_command,omitempty"`
+	Scripts         []string               `json:"scripts,omitempty"`
 	Type            string                 `json:"type"`
-	ExtraArguments  []string               `json:"extra_arguments"`
+	ExtraArguments  []string               `json:"extra_arguments,omitempty"`
 }
 
-func AnsibleGetProvisioner(config api.KubernetesConfiguration) (*AnsibleProvisioner, error) {
-	// err, args := GetAnsibleArguments(config)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	args := make(map[string]interface{})
-	extra := []string{"--extra-vars"}
-	for k, v := range args {
-		extra = append(extra, fmt.Sprintf("%s=%s", k, v))
+// AnsibleGetProvisioner returns a provisioner that runs playbook from the extracted CAPI ansible tree in dir
+func AnsibleGetProvisioner(config api.KubernetesConfiguration, dir, playbook string, overrides map[string]interface{}) (*AnsibleProvisioner, error) {
+	vars, err := AnsibleVars(config, overrides)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return nil, err
 	}
-
-	// if err := ExtractTo(".ansible"); err != nil {
-	// 	return nil, err
-	// }
-
 	return &AnsibleProvisioner{
 		Type:     "ansible",
-		Playbook: "./.ansible/playbook.yml",
+		Playbook: filepath.Join(dir, playbook),
 		EnvironmentVars: []string{
-			"ANSIBLE_SSH_ARGS='{{user `existing_ansible_ssh_args`}} -o IdentitiesOnly=yes'",
-			"ANSIBLE_REMOTE_TEMP='/tmp/.ansible/'",
+			"ANSIBLE_CONFIG=" + filepath.Join(dir, "ansible.cfg"),
+			"ANSIBLE_SSH_ARGS=-o IdentitiesOnly=yes",
+			"ANSIBLE_REMOTE_TEMP=/tmp/.ansible/",
 		},
-		ExtraArguments: extra,
+		ExtraArguments: []string{"--extra-vars", string(data)},
 	}, nil
-
-}
-func merge(m1, m2 map[string]interface{}) map[string]interface{} {
-	for k, v := range m2 {
-		m1[k] = v
-	}
-	return m1
 }
 
 func extract(fs http.FileSystem, file http.File, path string, to string) error {
@@ -145,13 +121,13 @@ func extract(fs http.FileSystem, file http.File, path string, to string) error {
 				return fmt.Errorf("failed top open %s: %v", childPath, err)
 			}
 			if childInfo.IsDir() {
-				if err := extract(fs, child, childPath, to); err != nil {
-					return fmt.Errorf("failed to extract directory %s: %v", childPath, err)
-				}
+				err = extract(fs, child, childPath, to)
 			} else {
-				if _, err := files.CopyFromReader(child, to+childPath, childInfo.Mode()); err != nil {
-					return err
-				}
+				_, err = files.CopyFromReader(child, to+childPath, childInfo.Mode())
+			}
+			child.Close()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %v", childPath, err)
 			}
 		}
 	} else {
@@ -165,12 +141,6 @@ func extract(fs http.FileSystem, file http.File, path string, to string) error {
 func NewPacker(ctx pkg.BuildContext) (*Packer, error) {
 	packer := Packer{}
 
-	tmp := "/Users/p01moshealei/Desktop/test5"
-	fs, _ := ansible.FS(false).Open("/ansible")
-	if err := extract(ansible.FS(false), fs, "/ansible", tmp); err != nil {
-		return nil, err
-	}
-
 	engine := ctx.Raw["engine"].(map[string]interface{})
 
 	if _, ok := engine["builders"]; !ok {
@@ -199,6 +169,18 @@ func NewPacker(ctx pkg.BuildContext) (*Packer, error) {
 		packer.Builders = append(packer.Builders, builder)
 	}
 
+	var playbook *AnsibleProvisioner
+	if name, ok := engine["playbook"]; ok {
+		provisioner, err := packer.ansible(ctx, fmt.Sprintf("%v", name), engine["ansible_vars"])
+		if err != nil {
+			return nil, err
+		}
+		playbook = provisioner
+		// kubernetes and the container runtime are installed by the playbook instead of konfigadm
+		ctx.Config.Konfigadm.Kubernetes = nil
+		ctx.Config.Konfigadm.ContainerRuntime = konfigadm.ContainerRuntime{}
+	}
+
 	bash, err := ctx.Config.Konfigadm.ToBash()
 	if err != nil {
 		return nil, err
@@ -209,24 +191,147 @@ func NewPacker(ctx pkg.BuildContext) (*Packer, error) {
 		version = ver.(string)
 	}
 	packer.binary = deps.Binary("packer", version, ".bin")
+	packer.format = defaultFormat(version)
+	if format, ok := engine["format"]; ok {
+		packer.format = fmt.Sprintf("%v", format)
+	}
+	if packer.format != FormatJSON && packer.format != FormatHCL {
+		return nil, fmt.Errorf("unknown packer format %s, valid options are: json,hcl", packer.format)
+	}
 	packer.manifestPath = files.TempFileName("manifest", ".json")
-	packer.Provisioners = []interface{}{ShellProvisioner{
-		Type:           "shell",
-		ExecuteCommand: "sudo sh -c '{{ .Vars }} {{ .Path }}'",
-		Scripts:        []string{bash},
-	}}
+	if strings.TrimSpace(bash) != "" {
+		if err := packer.AddCommand(bash); err != nil {
+			return nil, err
+		}
+	}
+	if playbook != nil {
+		packer.Provisioners = append(packer.Provisioners, playbook)
+	}
+	if err := ctx.Execute(&packer); err != nil {
+		return nil, err
+	}
 	packer.PostProcessors = []interface{}{
-		map[string]string{
-			"type":       "manifest",
-			"output":     packer.manifestPath,
-			"strip_path": "true",
+		map[string]interface{}{
+			"type":   "manifest",
+			"output": packer.manifestPath,
+			// paths are needed to find local artifacts such as disk images
+			"strip_path": false,
 		},
 	}
 	return &packer, nil
 }
 
+// tempDir returns a directory that is removed once the build completes
+func (packer *Packer) tempDir() (string, error) {
+	if packer.dir == "" {
+		dir, err := ioutil.TempDir("", "image-builder-packer")
+		if err != nil {
+			return "", err
+		}
+		packer.dir = dir
+	}
+	return packer.dir, nil
+}
+
+// ansible extracts the embedded CAPI playbooks and returns a provisioner for playbook
+func (packer *Packer) ansible(ctx pkg.BuildContext, playbook string, overrides interface{}) (*AnsibleProvisioner, error) {
+	tmp, err := packer.tempDir()
+	if err != nil {
+		return nil, err
+	}
+	fs := ansible.FS(false)
+	root, err := fs.Open("/ansible")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded playbooks: %v", err)
+	}
+	defer root.Close()
+	if err := extract(fs, root, "/ansible", tmp); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(tmp, "ansible")
+	if !files.Exists(filepath.Join(dir, playbook)) {
+		return nil, fmt.Errorf("playbook %s not found, it must be one of the embedded CAPI playbooks e.g. node.yml", playbook)
+	}
+	vars := make(map[string]interface{})
+	if overrides != nil {
+		m, ok := overrides.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("ansible_vars must be a map, got %T", overrides)
+		}
+		vars = m
+	}
+	ctx.Infof("Running %s with ansible from %s", playbook, dir)
+	return AnsibleGetProvisioner(ctx.Config, dir, playbook, vars)
+}
+
+// AddFile uploads contents to a temporary location using a file provisioner and then moves it into place
+func (packer *Packer) AddFile(path string, contents io.Reader) error {
+	dir, err := packer.tempDir()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s", len(packer.Provisioners), filepath.Base(path))
+	src := filepath.Join(dir, name)
+	if _, err := files.CopyFromReader(contents, src, 0644); err != nil {
+		return err
+	}
+	tmp := "/tmp/" + name
+	packer.Provisioners = append(packer.Provisioners, FileProvisioner{
+		Type:        "file",
+		Source:      src,
+		Destination: tmp,
+	})
+	return packer.AddCommand(fmt.Sprintf("mkdir -p %s && mv %s %s", filepath.Dir(path), tmp, path))
+}
+
+// AddCommand appends the commands to the last shell provisioner, or adds a new one if the last provisioner is not a shell
+func (packer *Packer) AddCommand(command ...string) error {
+	if len(packer.Provisioners) > 0 {
+		if shell, ok := packer.Provisioners[len(packer.Provisioners)-1].(ShellProvisioner); ok {
+			shell.Scripts = append(shell.Scripts, command...)
+			packer.Provisioners[len(packer.Provisioners)-1] = shell
+			return nil
+		}
+	}
+	packer.Provisioners = append(packer.Provisioners, ShellProvisioner{
+		Type:           "shell",
+		ExecuteCommand: "sudo sh -c '{{ .Vars }} {{ .Path }}'",
+		Scripts:        command,
+	})
+	return nil
+}
+
+// AddAnsiblePlaybook runs the playbook from the host using the ansible provisioner
+func (packer *Packer) AddAnsiblePlaybook(playbook string, vars map[string]interface{}) error {
+	provisioner := AnsibleProvisioner{
+		Type:     "ansible",
+		Playbook: playbook,
+		EnvironmentVars: []string{
+			"ANSIBLE_REMOTE_TEMP=/tmp/.ansible/",
+		},
+	}
+	if len(vars) > 0 {
+		data, err := json.Marshal(vars)
+		if err != nil {
+			return fmt.Errorf("invalid ansible vars: %v", err)
+		}
+		provisioner.ExtraArguments = []string{"--extra-vars", string(data)}
+	}
+	packer.Provisioners = append(packer.Provisioners, provisioner)
+	return nil
+}
+
 func (packer *Packer) Build(ctx pkg.BuildContext) (*Manifest, error) {
-	data, err := json.MarshalIndent(packer, "", "    ")
+	if packer.dir != "" {
+		defer os.RemoveAll(packer.dir)
+	}
+	var data []byte
+	var err error
+	if packer.format == FormatHCL {
+		data, err = packer.HCL()
+	} else {
+		data, err = json.MarshalIndent(packer, "", "    ")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -236,7 +341,7 @@ func (packer *Packer) Build(ctx pkg.BuildContext) (*Manifest, error) {
 		return &Manifest{}, nil
 	}
 
-	tmp := "packer-image-builder.json"
+	tmp := templateFile(packer.format)
 	if !logger.IsTraceEnabled() {
 		defer os.Remove(tmp)
 	}
@@ -17,20 +17,25 @@
 package engines
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
-	"github.com/flanksource/commons/console"
 	"github.com/flanksource/commons/files"
 	"github.com/flanksource/commons/logger"
 	"github.com/flanksource/commons/utils"
 	cloudinit "github.com/flanksource/konfigadm/pkg/cloud-init"
-	konfigadm "github.com/flanksource/konfigadm/pkg/types"
 
 	"sigs.k8s.io/image-builder/api"
 	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/cache"
+	"sigs.k8s.io/image-builder/pkg/converters/disk"
 )
 
 type Qemu struct {
@@ -55,124 +60,266 @@ func (q Qemu) Configure(ctx pkg.BuildContext) (api.Image, error) {
 		return input, nil
 	}
 
+	vm, err := newQemuVM(ctx.Config.Engine)
+	if err != nil {
+		return nil, err
+	}
+	defer vm.Close()
+
 	var scratch Scratch
 	if input.CaptureLogs != "" {
 		logger.Infof("Using scratch directory / disk")
-		scratch = NewScratch()
+		if scratch, err = NewScratch(); err != nil {
+			return nil, err
+		}
 	}
 
-	image, err := q.clone(ctx, input.URL)
+	image, err := q.clone(ctx, input)
 	if err != nil {
 		return nil, err
 	}
-	iso, err := createIso(&ctx.Config.Konfigadm)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build ISO %v", err)
-	}
-	if iso == "" {
-		return nil, fmt.Errorf("empty ISO created")
-	}
-	cmdLine := fmt.Sprintf(`\
-	-nodefaults \
-	-display none \
-	-machine accel=kvm:hvf \
-	-cpu host -smp cpus=2 \
-	-m 1024 \
-	-hda %s \
-	-cdrom %s \
-	-device virtio-serial-pci \
-	-serial stdio \
-	-net nic -net user,hostfwd=tcp:127.0.0.1:2022-:22`, image, iso)
+	scratchImg := ""
 	if input.CaptureLogs != "" {
-		cmdLine += fmt.Sprintf(" -hdb %s", scratch.GetImg())
+		scratchImg = scratch.GetImg()
 	}
-
-	logger.Infof("Executing %s", console.Greenf(cmdLine))
-	if err := ctx.GetBinary("qemu-system")(cmdLine); err != nil {
-		return nil, fmt.Errorf("failed to run: %s, %s", cmdLine, err)
+	consoleLog := vm.ConsoleLog
+	if consoleLog == "" {
+		consoleLog = strings.TrimSuffix(image, path.Ext(image)) + "-console.log"
+	}
+	if vm.Mode == ModeSSH {
+		err = provisionSSH(ctx, vm, input, image, scratchImg, consoleLog)
+	} else {
+		err = provisionCloudInit(ctx, vm, input, image, scratchImg, consoleLog)
 	}
+	// logs are copied even if the build failed, as that is when they are needed most
 	if input.CaptureLogs != "" {
-		logger.Infof("Coping captured logs to %s", input.CaptureLogs)
-		scratch.UnwrapToDir(input.CaptureLogs)
+		logger.Infof("Copying captured logs to %s", input.CaptureLogs)
+		if err := scratch.UnwrapToDir(input.CaptureLogs); err != nil {
+			logger.Errorf("Failed to copy captured logs: %v", err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure %s, see %s: %v", image, consoleLog, err)
+	}
+	// compacting also flattens the image as the overlay is converted into a new image
+	if input.Compact {
+		if err := compact(ctx, image); err != nil {
+			return nil, err
+		}
+	} else if input.Overlay == OverlayFlatten {
+		if err := flatten(ctx, image); err != nil {
+			return nil, err
+		}
 	}
 	return api.DiskImage{
 		URL: image,
 	}, nil
 }
 
-func (q Qemu) copyImage(ctx pkg.BuildContext, image string) (string, error) {
+// provisionCloudInit configures the image with a one-shot cloud-init seed that shuts the VM down when complete
+func provisionCloudInit(ctx pkg.BuildContext, vm *qemuVM, input api.DiskImage, image, scratch, consoleLog string) error {
+	sentinel := utils.RandomString(16)
+	seed, err := createSeed(ctx, vm, input, sentinel)
+	if err != nil {
+		return fmt.Errorf("failed to create cloud-init seed: %v", err)
+	}
+	defer os.Remove(seed)
+	args, err := vm.Args(image, seed, scratch)
+	if err != nil {
+		return err
+	}
+	return vm.Run(context.Background(), ctx, args, consoleLog, sentinel)
+}
+
+// zeroFillCommand fills the free space of the root filesystem with zeros so that it is not included in the compacted image
+const zeroFillCommand = "fstrim -av || true; dd if=/dev/zero of=/var/tmp/zero bs=1M || true; rm -f /var/tmp/zero; sync"
+
+// compact converts image into a compressed qcow2, leaving out any zeroed blocks
+func compact(ctx pkg.BuildContext, image string) error {
+	before, _ := os.Stat(image)
+	tmp := image + ".compact"
+	logger.Infof("Compacting %s", image)
+	if err := ctx.GetBinary("qemu-img")("convert -O qcow2 -c %s %s", image, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact %s: %v", image, err)
+	}
+	if ctx.DryRun {
+		return nil
+	}
+	if err := os.Rename(tmp, image); err != nil {
+		return err
+	}
+	if after, err := os.Stat(image); err == nil && before != nil {
+		logger.Infof("Compacted %s from %s to %s", image, cache.FormatSize(before.Size()), cache.FormatSize(after.Size()))
+	}
+	return nil
+}
 
+// copyImage copies src to a new base image, named after the input URL unless an output filename is specified.
+// Images that are overlays or will be compacted are qcow2, so they are named .qcow2 regardless of the input.
+func (q Qemu) copyImage(ctx pkg.BuildContext, src string) (string, error) {
 	from := ctx.Input.(api.DiskImage)
-	cachedImage := image
+	image := from.URL
+	ext := path.Ext(image)
+	if from.Overlay != "" || from.Compact {
+		ext = ".qcow2"
+	}
 	if from.OutputFilename != "" {
-		image = files.GetBaseName(from.OutputFilename) + path.Ext(image)
+		image = files.GetBaseName(from.OutputFilename) + ext
 	} else {
-		image = files.GetBaseName(image) + "-" + utils.ShortTimestamp() + path.Ext(image)
+		image = files.GetBaseName(image) + "-" + utils.ShortTimestamp() + ext
 	}
 
 	if from.OutputDir != "" {
 		image = path.Join(from.OutputDir, image)
 	}
 
-	logger.Infof("Creating new base image: %s", image)
-	if err := files.Copy(cachedImage, image); err != nil {
-		return "", fmt.Errorf("failed to create new base image %s, %s", image, err)
+	switch from.Overlay {
+	case "":
+		logger.Infof("Creating new base image: %s", image)
+		if err := files.Copy(src, image); err != nil {
+			return "", fmt.Errorf("failed to create new base image %s, %s", image, err)
+		}
+		logger.Infof("Created new base image")
+	case OverlayFlatten, OverlayLayered:
+		if err := createOverlay(ctx, src, image); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("invalid overlay %s, must be either %s or %s", from.Overlay, OverlayFlatten, OverlayLayered)
 	}
-	logger.Infof("Created new base image")
 	if from.ResizeGB > 0 {
-		logger.Infof("Resizing %s to %s\n", image, from.ResizeGB)
-		if err := ctx.GetBinary("qemu-img")("resize\"%s\" %sgb", image, from.ResizeGB); err != nil {
+		logger.Infof("Resizing %s to %dgb", image, from.ResizeGB)
+		if err := ctx.GetBinary("qemu-img")("resize %s %dG", image, from.ResizeGB); err != nil {
 			return "", fmt.Errorf("error resizing disk  %s", err)
 		}
 	}
 	return image, nil
 }
 
-func createIso(config *konfigadm.Config) (string, error) {
-	cloud_init := config.ToCloudInit()
+const (
+	// OverlayFlatten builds against a qcow2 overlay of the base image and then merges them into a standalone image
+	OverlayFlatten = "flatten"
+	// OverlayLayered builds against a qcow2 overlay of the base image and keeps the base image as its backing file
+	OverlayLayered = "layered"
+)
 
-	// if config.Context.CaptureLogs != "" {
-	// 	cloud_init.Runcmd = append([][]string{[]string{"bash", "-x", "-c", "mkdir /scratch; mount /dev/sdb1 /scratch"}}, cloud_init.Runcmd...)
-	// }
-	// if config.Context.CaptureLogs != "" && (config.Cleanup == nil || !*config.Cleanup) {
-	// 	cloud_init.Runcmd = append(cloud_init.Runcmd, []string{"bash", "-x", "-c", strings.Join(CaptureLogCommands(), "; ")})
-	// }
+// createOverlay creates a qcow2 image that only stores the changes made to base
+func createOverlay(ctx pkg.BuildContext, base, image string) error {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return err
+	}
+	format, err := disk.Detect(base)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Creating overlay %s backed by %s", image, base)
+	if err := ctx.GetBinary("qemu-img")("create -f qcow2 -F %s -b %s %s", format, base, image); err != nil {
+		return fmt.Errorf("failed to create overlay %s: %v", image, err)
+	}
+	return nil
+}
+
+// flatten merges an overlay and its backing files into a standalone qcow2 image
+func flatten(ctx pkg.BuildContext, image string) error {
+	tmp := image + ".flat"
+	logger.Infof("Flattening %s", image)
+	if err := ctx.GetBinary("qemu-img")("convert -O qcow2 %s %s", image, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to flatten %s: %v", image, err)
+	}
+	if ctx.DryRun {
+		return nil
+	}
+	return os.Rename(tmp, image)
+}
+
+// createSeed creates the cloud-init seed, the runcmd commands are tracked so that the sentinel is
+// only written to the console if all of them succeed
+func createSeed(ctx pkg.BuildContext, vm *qemuVM, input api.DiskImage, sentinel string) (string, error) {
+	cloud_init := ctx.Config.Konfigadm.ToCloudInit()
+	if err := ctx.Execute(cloudInitExecutor{&cloud_init}); err != nil {
+		return "", err
+	}
+
+	for i, cmd := range cloud_init.Runcmd {
+		cloud_init.Runcmd[i] = append([]string{"sh", "-c", `"$@" || echo "$*" >> ` + failedCommandsFile, "sh"}, cmd...)
+	}
+	cloud_init.Runcmd = append(cloud_init.Runcmd, []string{"sh", "-c", sentinelCommand(sentinel)})
+
+	if input.ResizeGB > 0 {
+		cloud_init.Growpart = cloudinit.Growpart{Mode: "auto", Devices: []string{"/"}, IgnoreGrowrootDisabled: true}
+	}
+	if input.CaptureLogs != "" {
+		// runcmd does not stop on the first failure, so the logs are captured even if provisioning fails
+		cloud_init.Runcmd = append([][]string{{"sh", "-c", MountScratchCommand}}, cloud_init.Runcmd...)
+		cloud_init.Runcmd = append(cloud_init.Runcmd, []string{"sh", "-c", strings.Join(CaptureLogCommands(), "; ")})
+	}
 
 	logger.Tracef(cloud_init.String())
 	// PowerState is once per instance and cloud-init clean (creating a new instance) fails on ubuntu 18.04:
 	// IsADirectory: /var/lib/cloud/instance
 	//	"cloud_init.PowerState.Mode = "poweroff"
 	// so we append a shutdown manually
+	if input.Compact {
+		cloud_init.Runcmd = append(cloud_init.Runcmd, []string{"sh", "-c", zeroFillCommand})
+	}
 	cloud_init.Runcmd = append(cloud_init.Runcmd, []string{"shutdown", "-h", "now"})
-	return cloudinit.CreateISO("builder", cloud_init.String())
+	userData := cloud_init.String()
+	if input.ResizeGB > 0 {
+		// resize_rootfs is not part of the konfigadm cloud-init types
+		userData += "resize_rootfs: true\n"
+	}
+	seed, err := newNoCloudSeed(vm, userData)
+	if err != nil {
+		return "", err
+	}
+	return seed.Create()
+}
+
+// cloudInitExecutor adds provisioning steps to cloud-init user-data
+type cloudInitExecutor struct {
+	*cloudinit.CloudInit
 }
 
-func (q Qemu) downloadImage(ctx pkg.BuildContext, image string) string {
-	if !strings.HasPrefix(image, "http") {
-		return image
+func (c cloudInitExecutor) AddFile(path string, contents io.Reader) error {
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return err
 	}
-	home, _ := os.UserHomeDir()
-	imageCache := home + "/.konfigadm/images"
-	basename := path.Base(image)
-	cachedImage := imageCache + "/" + basename
-	if files.Exists(cachedImage) {
-		// TODO(moshloop) verify SHASUM
-		logger.Infof("Image found in cache: %s", basename)
-	} else {
-		logger.Infof("Downloading image %s", image)
-		if err := os.MkdirAll(imageCache, 0755); err != nil {
-			logger.Fatalf("Failed to create cache dir %s", imageCache)
-		}
-		if err := ctx.GetBinary("wget")("--no-check-certificate -nv -O %s %s", cachedImage, image); err != nil {
-			logger.Fatalf("Failed to download image %s, %s", image, err)
-		}
+	c.WriteFiles = append(c.WriteFiles, cloudinit.File{
+		Path:     path,
+		Content:  base64.StdEncoding.EncodeToString(data),
+		Encoding: "b64",
+	})
+	return nil
+}
+
+func (c cloudInitExecutor) AddCommand(command ...string) error {
+	for _, cmd := range command {
+		c.Runcmd = append(c.Runcmd, []string{"sh", "-c", cmd})
+	}
+	return nil
+}
+
+// downloadImage downloads the input image into the cache, verifying its checksum if one is specified
+func (q Qemu) downloadImage(input api.DiskImage) (string, error) {
+	c := cache.New("")
+	checksum, err := c.ResolveChecksum(input.URL, input.Checksum, input.ChecksumType)
+	if err != nil {
+		return "", err
 	}
-	return cachedImage
+	return c.Fetch(input.URL, checksum)
 }
 
-func (q Qemu) clone(ctx pkg.BuildContext, image string) (string, error) {
+func (q Qemu) clone(ctx pkg.BuildContext, input api.DiskImage) (string, error) {
+	image := input.URL
 	if strings.HasPrefix(image, "http") {
-		image = q.downloadImage(ctx, image)
+		var err error
+		if image, err = q.downloadImage(input); err != nil {
+			return "", err
+		}
 	}
 
 	image, err := q.copyImage(ctx, image)
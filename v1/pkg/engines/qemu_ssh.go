@@ -0,0 +1,284 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package engines
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/commons/logger"
+	cloudinit "github.com/flanksource/konfigadm/pkg/cloud-init"
+	"golang.org/x/crypto/ssh"
+
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/api/executors"
+	"sigs.k8s.io/image-builder/pkg"
+)
+
+// sshUser is created by cloud-init with the ephemeral key and removed before the VM is shut down
+const sshUser = "image-builder"
+
+// removeSSHUserCommand removes the build user and shuts down in the background, so that the SSH session can close first
+const removeSSHUserCommand = "(sleep 2; userdel -rf " + sshUser + "; sed -i '/^" + sshUser + " /d' /etc/sudoers.d/90-cloud-init-users; shutdown -h now) > /dev/null 2>&1 &"
+
+// provisionSSH boots the VM with an ephemeral key, runs the konfigadm config and provisioning steps over SSH and then shuts it down
+func provisionSSH(ctx pkg.BuildContext, vm *qemuVM, input api.DiskImage, image, scratch, consoleLog string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	seed, err := createSSHSeed(vm, input, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))))
+	if err != nil {
+		return fmt.Errorf("failed to create cloud-init seed: %v", err)
+	}
+	defer os.Remove(seed)
+	args, err := vm.Args(image, seed, scratch)
+	if err != nil {
+		return err
+	}
+	if ctx.DryRun {
+		return vm.Run(context.Background(), ctx, args, consoleLog, "")
+	}
+
+	stop, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// exited is closed after the result is sent, so that it can be waited on again once waitForSSH has received it
+	exited := make(chan error, 1)
+	go func() {
+		exited <- vm.Run(stop, ctx, args, consoleLog, "")
+		close(exited)
+	}()
+
+	client, err := waitForSSH(vm.SSHPort, signer, vm.timeout, exited)
+	if err != nil {
+		cancel()
+		<-exited
+		return err
+	}
+	defer client.Close()
+	executor := &sshExecutor{client: client, port: vm.SSHPort, key: key}
+	defer executor.Close()
+
+	err = provision(ctx, executor)
+	// logs are captured and free space zeroed even if provisioning failed, failures are ignored
+	if input.CaptureLogs != "" {
+		executor.run(MountScratchCommand+"; "+strings.Join(CaptureLogCommands(), "; "), nil) // nolint: errcheck
+	}
+	if err == nil && input.Compact {
+		err = executor.AddCommand(zeroFillCommand)
+	}
+	logger.Infof("Shutting down VM")
+	executor.run(removeSSHUserCommand, nil) // nolint: errcheck
+	if runErr := <-exited; err == nil {
+		err = runErr
+	}
+	return err
+}
+
+// provision applies the konfigadm config and then each provisioning step
+func provision(ctx pkg.BuildContext, executor *sshExecutor) error {
+	if err := (executors.Konfigadm{Config: &ctx.Config.Konfigadm}).Execute(&ctx.Input, executor); err != nil {
+		return err
+	}
+	return ctx.Execute(executor)
+}
+
+// createSSHSeed creates a cloud-init seed that only adds the build user with the ephemeral key
+func createSSHSeed(vm *qemuVM, input api.DiskImage, authorizedKey string) (string, error) {
+	cloud_init := cloudinit.CloudInit{
+		Users: []cloudinit.User{{
+			Name:              sshUser,
+			Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+			SSHAuthorizedKeys: []string{authorizedKey},
+		}},
+	}
+	userData := cloud_init.String()
+	if input.ResizeGB > 0 {
+		cloud_init.Growpart = cloudinit.Growpart{Mode: "auto", Devices: []string{"/"}, IgnoreGrowrootDisabled: true}
+		userData = cloud_init.String() + "resize_rootfs: true\n"
+	}
+	seed, err := newNoCloudSeed(vm, userData)
+	if err != nil {
+		return "", err
+	}
+	return seed.Create()
+}
+
+// waitForSSH connects to the forwarded SSH port once the VM has booted
+func waitForSSH(port int, signer ssh.Signer, timeout time.Duration, exited <-chan error) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User: sshUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// the host key is generated on first boot, the connection is only to the local port forward
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	logger.Infof("Waiting for SSH on %s", addr)
+	deadline := time.Now().Add(timeout)
+	for {
+		client, err := ssh.Dial("tcp", addr, config)
+		if err == nil {
+			return client, nil
+		}
+		logger.Debugf("SSH not available yet: %v", err)
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for SSH on %s: %v", addr, err)
+		}
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("VM exited before SSH was available: %v", err)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// sshExecutor runs provisioning steps in the VM over SSH, playbooks are run by ansible on the host against the VM
+type sshExecutor struct {
+	client  *ssh.Client
+	port    int
+	key     *ecdsa.PrivateKey
+	keyFile string
+}
+
+func (s *sshExecutor) run(command string, stdin io.Reader) error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	out := &prefixWriter{prefix: console.Grayf("[ssh]")}
+	defer out.Flush()
+	session.Stdin = stdin
+	session.Stdout = out
+	session.Stderr = out
+	return session.Run(command)
+}
+
+func (s *sshExecutor) AddFile(file string, contents io.Reader) error {
+	script := fmt.Sprintf("mkdir -p %s && cat > %s", executors.Quote(path.Dir(file)), executors.Quote(file))
+	if err := s.run("sudo sh -c "+executors.Quote(script), contents); err != nil {
+		return fmt.Errorf("failed to copy %s: %v", file, err)
+	}
+	return nil
+}
+
+func (s *sshExecutor) AddCommand(command ...string) error {
+	for _, cmd := range command {
+		logger.Infof("Running %s", console.Greenf(cmd))
+		if err := s.run("sudo sh -c "+executors.Quote(cmd), nil); err != nil {
+			return fmt.Errorf("%s failed: %v", cmd, err)
+		}
+	}
+	return nil
+}
+
+func (s *sshExecutor) AddAnsiblePlaybook(playbook string, vars map[string]interface{}) error {
+	if s.keyFile == "" {
+		der, err := x509.MarshalECPrivateKey(s.key)
+		if err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile("", "image-builder-key")
+		if err != nil {
+			return err
+		}
+		s.keyFile = f.Name()
+		err = pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	args := []string{
+		"-i", "127.0.0.1,",
+		"-e", fmt.Sprintf("ansible_port=%d", s.port),
+		"-u", sshUser,
+		"--private-key", s.keyFile,
+		"--ssh-extra-args", "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null",
+		"--become",
+	}
+	if len(vars) > 0 {
+		data, err := json.Marshal(vars)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--extra-vars", string(data))
+	}
+	args = append(args, playbook)
+	logger.Infof("Running ansible-playbook %s", console.Greenf(strings.Join(args, " ")))
+	cmd := exec.Command("ansible-playbook", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ansible-playbook %s failed: %v", playbook, err)
+	}
+	return nil
+}
+
+// Close removes the private key written for ansible
+func (s *sshExecutor) Close() {
+	if s.keyFile != "" {
+		os.Remove(s.keyFile)
+	}
+}
+
+// prefixWriter logs each line written to it with a prefix
+type prefixWriter struct {
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// keep the incomplete line until the rest of it is written
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		logger.Infof("%s %s", w.prefix, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// Flush logs any incomplete last line
+func (w *prefixWriter) Flush() {
+	if w.buf.Len() > 0 {
+		logger.Infof("%s %s", w.prefix, w.buf.String())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package engines
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/commons/files"
+	"github.com/flanksource/commons/logger"
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/pkg"
+)
+
+const (
+	qemuBinary = "qemu-system-x86_64"
+	// ModeCloudInit provisions the VM using a one-shot cloud-init seed
+	ModeCloudInit = "cloud-init"
+	// ModeSSH provisions the VM over SSH using an ephemeral key
+	ModeSSH = "ssh"
+	// failedCommandsFile lists the cloud-init commands that failed inside the guest
+	failedCommandsFile = "/run/image-builder.failed"
+	// consoleMarker prefixes the lines written to the console by the final cloud-init command
+	consoleMarker = "IMAGE_BUILDER_"
+)
+
+// ovmfPaths are the usual locations of the UEFI firmware installed by the ovmf / edk2 packages
+var ovmfPaths = []string{
+	"/usr/share/OVMF/OVMF_CODE.fd",
+	"/usr/share/ovmf/OVMF.fd",
+	"/usr/share/edk2/ovmf/OVMF_CODE.fd",
+	"/usr/share/edk2-ovmf/x64/OVMF_CODE.fd",
+	"/usr/share/qemu/OVMF.fd",
+	"/usr/share/qemu/edk2-x86_64-code.fd",
+	"/usr/local/share/qemu/edk2-x86_64-code.fd",
+	"/opt/homebrew/share/qemu/edk2-x86_64-code.fd",
+}
+
+// qemuVM is the hardware of the VM used to configure an image
+type qemuVM struct {
+	api.QemuEngine
+	timeout time.Duration
+	// cleanup lists temporary files created for the VM, e.g. UEFI variables
+	cleanup []string
+}
+
+func newQemuVM(opts map[string]interface{}) (*qemuVM, error) {
+	engine, err := api.GetQemuEngine(opts)
+	if err != nil {
+		return nil, err
+	}
+	vm := &qemuVM{QemuEngine: engine}
+	if vm.CPUs == 0 {
+		vm.CPUs = 2
+	}
+	if vm.Memory == 0 {
+		vm.Memory = 1024
+	}
+	switch vm.DiskInterface {
+	case "":
+		vm.DiskInterface = "virtio"
+	case "virtio", "ide", "scsi":
+	default:
+		return nil, fmt.Errorf("invalid disk_interface %s, must be one of virtio, ide or scsi", vm.DiskInterface)
+	}
+	switch vm.Firmware {
+	case "":
+		vm.Firmware = "bios"
+	case "bios", "uefi":
+	default:
+		return nil, fmt.Errorf("invalid firmware %s, must be either bios or uefi", vm.Firmware)
+	}
+	if vm.Accel, err = accelerator(vm.Accel); err != nil {
+		return nil, err
+	}
+	if vm.CPU == "" {
+		vm.CPU = "host"
+		if vm.Accel == "tcg" {
+			vm.CPU = "max"
+		}
+	}
+	switch vm.Mode {
+	case "":
+		vm.Mode = ModeCloudInit
+	case ModeCloudInit, ModeSSH:
+	default:
+		return nil, fmt.Errorf("invalid mode %s, must be either %s or %s", vm.Mode, ModeCloudInit, ModeSSH)
+	}
+	if vm.Timeout == "" {
+		vm.Timeout = "1h"
+	}
+	if vm.timeout, err = time.ParseDuration(vm.Timeout); err != nil {
+		return nil, fmt.Errorf("invalid timeout %s: %v", vm.Timeout, err)
+	}
+	if vm.SSHPort == 0 {
+		if vm.SSHPort, err = freePort(); err != nil {
+			return nil, fmt.Errorf("failed to find a free port for ssh: %v", err)
+		}
+	}
+	return vm, nil
+}
+
+// accelerator returns accel, or the best available accelerator for this host if accel is empty
+func accelerator(accel string) (string, error) {
+	switch accel {
+	case "kvm", "hvf", "tcg":
+		return accel, nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid accel %s, must be one of kvm, hvf or tcg", accel)
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return "hvf", nil
+	case "linux":
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+		if err == nil {
+			f.Close()
+			return "kvm", nil
+		}
+		logger.Warnf("KVM is not available (%v), falling back to TCG software emulation which is much slower", err)
+	}
+	return "tcg", nil
+}
+
+// freePort returns a port that is currently free on the loopback interface
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// drive returns the arguments to attach a disk image using the configured disk interface
+func (vm *qemuVM) drive(index int, image string, options string) []string {
+	file := "file=" + image + options
+	switch vm.DiskInterface {
+	case "ide":
+		return []string{"-drive", fmt.Sprintf("%s,if=ide,index=%d", file, index)}
+	case "scsi":
+		return []string{
+			"-drive", fmt.Sprintf("%s,if=none,id=disk%d", file, index),
+			"-device", fmt.Sprintf("scsi-hd,drive=disk%d,bus=scsi0.0", index),
+		}
+	}
+	return []string{"-drive", fmt.Sprintf("%s,if=virtio,index=%d", file, index)}
+}
+
+// firmware returns the arguments to boot using UEFI, or nothing for the default BIOS
+func (vm *qemuVM) firmware() ([]string, error) {
+	if vm.Firmware != "uefi" {
+		return nil, nil
+	}
+	ovmf := vm.OVMF
+	if ovmf == "" {
+		for _, path := range ovmfPaths {
+			if files.Exists(path) {
+				ovmf = path
+				break
+			}
+		}
+		if ovmf == "" {
+			return nil, fmt.Errorf("no UEFI firmware found in %s, install OVMF or specify its path with ovmf", strings.Join(ovmfPaths, ", "))
+		}
+	}
+	base := path.Base(ovmf)
+	if !strings.Contains(base, "CODE") && !strings.Contains(base, "code") {
+		// a combined image containing both the code and variables
+		return []string{"-bios", ovmf}, nil
+	}
+
+	// split images need a writable copy of the variables template
+	vars := strings.Replace(strings.Replace(ovmf, "CODE", "VARS", 1), "code", "vars", 1)
+	tmp, err := ioutil.TempFile("", "ovmf-vars*.fd")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	vm.cleanup = append(vm.cleanup, tmp.Name())
+	if files.Exists(vars) {
+		if err := files.Copy(vars, tmp.Name()); err != nil {
+			return nil, err
+		}
+	} else if err := os.Truncate(tmp.Name(), 64*1024); err != nil {
+		return nil, err
+	}
+	return []string{
+		"-drive", "if=pflash,format=raw,readonly=on,file=" + ovmf,
+		"-drive", "if=pflash,format=raw,file=" + tmp.Name(),
+	}, nil
+}
+
+// Args returns the qemu arguments to boot image with the cloud-init seed and an optional scratch disk
+func (vm *qemuVM) Args(image, seed, scratch string) ([]string, error) {
+	firmware, err := vm.firmware()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"-nodefaults",
+		"-display", "none",
+		"-machine", "accel=" + vm.Accel,
+		"-cpu", vm.CPU,
+		"-smp", fmt.Sprintf("cpus=%d", vm.CPUs),
+		"-m", fmt.Sprintf("%d", vm.Memory),
+	}
+	args = append(args, firmware...)
+	if vm.DiskInterface == "scsi" {
+		args = append(args, "-device", "virtio-scsi-pci,id=scsi0")
+	}
+	args = append(args, vm.drive(0, image, "")...)
+	if scratch != "" {
+		args = append(args, vm.drive(1, scratch, ",format=raw")...)
+	}
+	// the seed is found by its cidata label, so its position does not matter
+	args = append(args, vm.drive(2, seed, ",format=raw")...)
+	args = append(args,
+		"-device", "virtio-serial-pci",
+		"-serial", "stdio",
+		"-net", "nic",
+		"-net", fmt.Sprintf("user,hostfwd=tcp:127.0.0.1:%d-:22", vm.SSHPort),
+	)
+	for _, arg := range vm.ExtraArgs {
+		args = append(args, strings.Fields(arg)...)
+	}
+	return args, nil
+}
+
+// sentinelCommand writes the sentinel to the console if no command failed, or the failed commands otherwise. The marker
+// is assembled by printf so that the sentinel is not found in any echo of the command itself.
+func sentinelCommand(sentinel string) string {
+	return fmt.Sprintf(`if [ -e %[1]s ]; then while read cmd; do printf '%%s%%s: %%s\n' %[2]s FAILED "$cmd"; done < %[1]s; `+
+		`else printf '%%s%%s\n' %[2]s %[3]s; fi > /dev/ttyS0`, failedCommandsFile, consoleMarker, sentinel)
+}
+
+// Run boots the VM, streaming the serial console to consoleLog and the build output, and returns an error unless
+// the sentinel is written to the console before qemu exits and within the timeout. An empty sentinel is not checked.
+func (vm *qemuVM) Run(parent context.Context, ctx pkg.BuildContext, args []string, consoleLog, sentinel string) error {
+	logger.Infof("Executing %s", console.Greenf("%s %s", qemuBinary, strings.Join(args, " ")))
+	if ctx.DryRun {
+		return nil
+	}
+	log, err := os.Create(consoleLog)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	timeout, cancel := context.WithTimeout(parent, vm.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(timeout, qemuBinary, args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", qemuBinary, err)
+	}
+
+	go func() {
+		// unblock the reader if the timeout kills qemu while a child process still holds the console open
+		<-timeout.Done()
+		stdout.Close()
+	}()
+
+	succeeded := false
+	var failed []string
+	reader := bufio.NewReader(io.TeeReader(stdout, log))
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			logger.Infof("%s %s", console.Grayf("[console]"), line)
+		}
+		switch {
+		case strings.Contains(line, consoleMarker+sentinel):
+			succeeded = true
+		case strings.Contains(line, consoleMarker+"FAILED: "):
+			failed = append(failed, line[strings.Index(line, consoleMarker+"FAILED: ")+len(consoleMarker+"FAILED: "):])
+		}
+		if err != nil {
+			break
+		}
+	}
+	err = cmd.Wait()
+	switch {
+	case timeout.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("timed out after %s", vm.timeout)
+	case parent.Err() != nil:
+		return parent.Err()
+	case err != nil:
+		return fmt.Errorf("%s failed: %v", qemuBinary, err)
+	case len(failed) > 0:
+		return fmt.Errorf("commands failed: %s", strings.Join(failed, ", "))
+	case sentinel != "" && !succeeded:
+		return fmt.Errorf("the VM shut down before provisioning completed")
+	}
+	return nil
+}
+
+// Close removes any temporary files created for the VM
+func (vm *qemuVM) Close() {
+	for _, file := range vm.cleanup {
+		os.Remove(file)
+	}
+}
@@ -0,0 +1,473 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package engines
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/deps"
+	"github.com/flanksource/commons/files"
+	"github.com/flanksource/commons/logger"
+
+	"sigs.k8s.io/image-builder/api"
+	"sigs.k8s.io/image-builder/api/executors"
+	"sigs.k8s.io/image-builder/pkg"
+	"sigs.k8s.io/image-builder/pkg/oci"
+	"sigs.k8s.io/image-builder/pkg/registry"
+)
+
+// Rootfs configures container images without a docker daemon, the image is unpacked into a directory and the
+// provisioning script is run inside it using bubblewrap, proot or chroot. The changes are saved as a single new
+// layer on top of the original image, which is written as an OCI image layout.
+type Rootfs struct {
+}
+
+func (r Rootfs) String() string {
+	return "rootfs"
+}
+
+func (r Rootfs) Kind() string {
+	return "rootfs"
+}
+
+func (r Rootfs) CanConfigure(source api.Image) bool {
+	return source.Kind() == api.DockerImageKind
+}
+
+// runners in order of preference, bwrap and proot do not require root
+var runners = []string{"bwrap", "proot", "chroot"}
+
+// provisionDir is where the script and files are staged inside the rootfs, it is removed before the diff is taken
+const provisionDir = "/tmp/image-builder"
+
+// Configures an image and returns the result or an error
+func (r Rootfs) Configure(ctx pkg.BuildContext) (api.Image, error) {
+	engine, err := api.GetRootfsEngine(ctx.Config.Engine)
+	if err != nil {
+		return nil, err
+	}
+	runner := engine.Runner
+	for _, name := range runners {
+		if runner != "" {
+			break
+		}
+		if deps.Which(name) && (name != "chroot" || os.Geteuid() == 0) {
+			runner = name
+		}
+	}
+	switch runner {
+	case "bwrap", "proot", "chroot":
+	case "":
+		return nil, fmt.Errorf("no runner found, install bubblewrap or proot, or run as root to use chroot")
+	default:
+		return nil, fmt.Errorf("invalid runner %s, must be one of %s", runner, strings.Join(runners, ", "))
+	}
+
+	dir, err := ioutil.TempDir("", "image-builder-rootfs")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := RemoveRoot(dir); err != nil {
+			logger.Warnf("%v", err)
+		}
+	}()
+	root := path.Join(dir, "rootfs")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	executor := &rootfsExecutor{root: root}
+	if err := addKonfigadm(ctx, executor); err != nil {
+		return nil, err
+	}
+	if err := ctx.Execute(executor); err != nil {
+		return nil, err
+	}
+	input := ctx.Input.(api.DockerImage)
+	if ctx.DryRun {
+		fmt.Println(executor.Script())
+		return api.OCIImage{}, nil
+	}
+
+	manifest, err := fetchImage(input, dir)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Unpacking %s", input)
+	for _, layer := range manifest.Layers {
+		f, err := os.Open(path.Join(dir, oci.BlobName(layer.Digest)))
+		if err != nil {
+			return nil, err
+		}
+		err = oci.Unpack(f, root)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack %s: %v", layer.Digest, err)
+		}
+	}
+	before, err := oci.TakeSnapshot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := executor.Run(ctx, runner); err != nil {
+		return nil, err
+	}
+
+	out := api.OCIImage{
+		URL: strings.NewReplacer("/", "-", ":", "-").Replace(input.Image+"-image-builder:"+input.Tag) + ".tar",
+		Ref: input.Tag,
+	}
+	if out.Digest, err = writeLayout(dir, root, before, manifest, out); err != nil {
+		return nil, err
+	}
+	logger.Infof("Saved %s@%s", out, out.Digest)
+	return out, nil
+}
+
+// fetchImage saves the config and layers of the input image to dir, either from its OCI layout or from its registry
+func fetchImage(input api.DockerImage, dir string) (oci.Manifest, error) {
+	platform := oci.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	if input.Archive == "" {
+		repo, err := registry.ParseRepository(input.Image)
+		if err != nil {
+			return oci.Manifest{}, err
+		}
+		repo.ReadOnly = true
+		repo.Username, repo.Password = os.Getenv("REGISTRY_USERNAME"), os.Getenv("REGISTRY_PASSWORD")
+		if err := repo.LoadDockerCredentials(); err != nil {
+			return oci.Manifest{}, err
+		}
+		reference := input.Tag
+		if strings.HasPrefix(input.Checksum, "sha256:") {
+			reference = input.Checksum
+		} else if reference == "" {
+			reference = "latest"
+		}
+		manifest, _, err := repo.Pull(reference, platform, dir)
+		return manifest, err
+	}
+
+	archive, err := oci.OpenArchive(input.Archive)
+	if err != nil {
+		return oci.Manifest{}, err
+	}
+	defer archive.Close()
+	manifest, err := archive.Image(platform)
+	if err != nil {
+		return manifest, fmt.Errorf("%s: %v", input.Archive, err)
+	}
+	for _, blob := range append([]oci.Descriptor{manifest.Config}, manifest.Layers...) {
+		r, err := archive.Blob(blob.Digest)
+		if err != nil {
+			return manifest, err
+		}
+		if _, err := files.CopyFromReader(r, path.Join(dir, oci.BlobName(blob.Digest)), 0644); err != nil {
+			return manifest, err
+		}
+	}
+	return manifest, nil
+}
+
+// ociMediaType returns the OCI equivalent of the docker media types
+func ociMediaType(mediaType string) string {
+	switch mediaType {
+	case "application/vnd.docker.container.image.v1+json":
+		return oci.MediaTypeConfig
+	case "application/vnd.docker.image.rootfs.diff.tar.gzip":
+		return oci.MediaTypeLayerGzip
+	case "application/vnd.docker.image.rootfs.diff.tar":
+		return oci.MediaTypeLayer
+	}
+	return mediaType
+}
+
+// writeLayout writes the original image with a new layer containing the changes made to root since before,
+// returning the digest of the new image manifest
+func writeLayout(dir, root string, before oci.Snapshot, manifest oci.Manifest, out api.OCIImage) (string, error) {
+	layerFile := path.Join(dir, "layer.tar.gz")
+	f, err := os.Create(layerFile)
+	if err != nil {
+		return "", err
+	}
+	diffID := sha256.New()
+	zw := gzip.NewWriter(f)
+	err = oci.Diff(root, before, io.MultiWriter(zw, diffID))
+	if err == nil {
+		err = zw.Close()
+	}
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to create layer: %v", err)
+	}
+
+	// unknown fields in the config are preserved
+	var config map[string]interface{}
+	data, err := ioutil.ReadFile(path.Join(dir, oci.BlobName(manifest.Config.Digest)))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("invalid image config: %v", err)
+	}
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, fmt.Sprintf("sha256:%x", diffID.Sum(nil)))
+	config["rootfs"] = rootfs
+	created := time.Now().UTC().Format(time.RFC3339)
+	history, _ := config["history"].([]interface{})
+	config["history"] = append(history, map[string]interface{}{
+		"created":    created,
+		"created_by": "image-builder",
+	})
+	config["created"] = created
+	if data, err = json.Marshal(config); err != nil {
+		return "", err
+	}
+
+	tmp := out.URL + ".tmp"
+	w, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	layout := oci.NewLayout(w)
+	configDesc, err := layout.AddBlob(oci.MediaTypeConfig, data)
+	if err != nil {
+		w.Close()
+		return "", err
+	}
+	var layers []oci.Descriptor
+	for _, layer := range manifest.Layers {
+		desc, err := layout.AddBlobFile(ociMediaType(layer.MediaType), path.Join(dir, oci.BlobName(layer.Digest)))
+		if err != nil {
+			w.Close()
+			return "", err
+		}
+		layers = append(layers, desc)
+	}
+	layer, err := layout.AddBlobFile(oci.MediaTypeLayerGzip, layerFile)
+	if err != nil {
+		w.Close()
+		return "", err
+	}
+	desc, err := layout.AddManifest(configDesc, append(layers, layer), out.Ref, nil)
+	if err == nil {
+		err = layout.Close()
+	}
+	w.Close()
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, os.Rename(tmp, out.URL)
+}
+
+// rootfsExecutor stages files inside the rootfs and copies them into place from the provisioning script,
+// so that any symlinks are resolved inside the rootfs rather than on the host
+type rootfsExecutor struct {
+	root   string
+	files  map[string][]byte
+	script []string
+}
+
+func (e *rootfsExecutor) AddFile(dst string, contents io.Reader) error {
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+	if e.files == nil {
+		e.files = make(map[string][]byte)
+	}
+	src := fmt.Sprintf("%s/files/%d", provisionDir, len(e.files))
+	e.files[src] = data
+	e.script = append(e.script, fmt.Sprintf("mkdir -p %s && cp %s %s", executors.Quote(path.Dir(dst)), src, executors.Quote(dst)))
+	return nil
+}
+
+func (e *rootfsExecutor) AddCommand(command ...string) error {
+	for _, cmd := range command {
+		if strings.TrimSpace(cmd) != "" {
+			e.script = append(e.script, cmd)
+		}
+	}
+	return nil
+}
+
+// Script returns the provisioning script
+func (e *rootfsExecutor) Script() string {
+	return strings.Join(e.script, "\n") + "\n"
+}
+
+// Run stages the files and script in the rootfs, runs the script using runner and then removes them
+func (e *rootfsExecutor) Run(ctx pkg.BuildContext, runner string) error {
+	// the staging directory must not be a symlink that resolves outside of the rootfs
+	files0, err := oci.SafePath(e.root, provisionDir+"/files/0")
+	if err != nil {
+		return err
+	}
+	staging := filepath.Join(e.root, provisionDir)
+	if tmp := filepath.Dir(staging); !files.Exists(tmp) {
+		defer os.RemoveAll(tmp)
+	}
+	if err := os.MkdirAll(filepath.Dir(files0), 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	for src, data := range e.files {
+		if _, err := files.CopyFromReader(strings.NewReader(string(data)), filepath.Join(e.root, src), 0644); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, "provision.sh"), []byte(e.Script()), 0755); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf("if command -v bash > /dev/null; then exec bash -ex %[1]s; else exec sh -ex %[1]s; fi", provisionDir+"/provision.sh")
+	logger.Infof("Running provisioning script using %s", runner)
+	switch runner {
+	case "bwrap":
+		err = ctx.GetBinary("bwrap")("--bind %s / --dev /dev --proc /proc --ro-bind /etc/resolv.conf /etc/resolv.conf "+
+			"--unshare-user --uid 0 --gid 0 --unshare-ipc --unshare-pid --unshare-uts --die-with-parent /bin/sh -c %s", e.root, executors.Quote(script))
+	case "proot":
+		err = ctx.GetBinary("proot")("-0 -r %s -b /dev -b /proc -b /sys -b /etc/resolv.conf -w / /bin/sh -c %s", e.root, executors.Quote(script))
+	case "chroot":
+		err = RunInChroot(ctx, e.root, script)
+	}
+	if err != nil {
+		return fmt.Errorf("provisioning failed: %v", err)
+	}
+	return nil
+}
+
+// RunInChroot runs script inside root with /proc, /sys and /dev mounted, and the host's DNS configuration. An error
+// is returned if any of the mounts cannot be unmounted, in which case root must not be removed.
+func RunInChroot(ctx pkg.BuildContext, root, script string) (err error) {
+	var mounted, created []string
+	defer func() {
+		var failed []string
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if uerr := ctx.GetBinary("umount")("-l %s", mounted[i]); uerr != nil {
+				failed = append(failed, mounted[i])
+			}
+		}
+		if len(failed) > 0 {
+			uerr := fmt.Errorf("failed to unmount %s", strings.Join(failed, ", "))
+			if err != nil {
+				uerr = fmt.Errorf("%v: %v", err, uerr)
+			}
+			err = uerr
+			return
+		}
+		// mount points that did not exist are removed so that they are not included in the diff
+		for _, dir := range created {
+			os.Remove(dir) // nolint: errcheck
+		}
+	}()
+	for _, mount := range []struct{ dir, args string }{
+		{"/proc", "-t proc proc"},
+		{"/sys", "--rbind /sys"},
+		{"/dev", "--rbind /dev"},
+	} {
+		target, err := oci.SafePath(root, mount.dir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+			created = append(created, target)
+		}
+		if err := ctx.GetBinary("mount")("%s %s", mount.args, target); err != nil {
+			return err
+		}
+		mounted = append(mounted, target)
+		// recursive bind mounts are made slaves so that unmounting them does not propagate back to the host
+		if strings.HasPrefix(mount.args, "--rbind") {
+			if err := ctx.GetBinary("mount")("--make-rslave %s", target); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the original resolv.conf, which is often a symlink, is restored afterwards
+	resolv, err := oci.SafePath(root, "/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(resolv); err == nil {
+		if err := os.Rename(resolv, resolv+".image-builder"); err != nil {
+			return err
+		}
+		defer func() {
+			os.Remove(resolv)
+			os.Rename(resolv+".image-builder", resolv) // nolint: errcheck
+		}()
+	} else {
+		defer os.Remove(resolv)
+	}
+	if err := files.Copy("/etc/resolv.conf", resolv); err != nil {
+		logger.Warnf("Failed to copy /etc/resolv.conf: %v", err)
+	}
+	return ctx.GetBinary("chroot")("%s /bin/sh -c %s", root, executors.Quote(script))
+}
+
+// RemoveRoot removes a directory that a rootfs was unpacked or mounted in, unless anything is still mounted
+// beneath it, as removing it would then delete files on the host or the mounted filesystems
+func RemoveRoot(dir string) error {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("not removing %s, failed to check for mounts: %v", dir, err)
+	}
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		// spaces and other special characters in mount points are octal escaped
+		target, err := strconv.Unquote(`"` + fields[4] + `"`)
+		if err != nil {
+			target = fields[4]
+		}
+		if target == resolved || strings.HasPrefix(target, resolved+"/") {
+			return fmt.Errorf("not removing %s, %s is still mounted", dir, target)
+		}
+	}
+	return os.RemoveAll(dir)
+}
@@ -17,12 +17,14 @@
 package engines
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"runtime"
 
 	"github.com/flanksource/commons/deps"
 	"github.com/flanksource/commons/logger"
+	"sigs.k8s.io/image-builder/pkg/fat"
 )
 
 var hdiutil = deps.Binary("hdiutil", "", "")
@@ -37,14 +39,23 @@ type DarwinScratch struct {
 	img string
 }
 
-func NewScratch() Scratch {
+// NewScratch creates a disk that the guest copies its logs to, it is extracted after the build with UnwrapToDir
+func NewScratch() (Scratch, error) {
 	var scratch Scratch
-	if runtime.GOOS == "darwin" {
+	switch runtime.GOOS {
+	case "darwin":
 		scratch = &DarwinScratch{}
+	case "linux":
+		scratch = &LinuxScratch{}
+	default:
+		return nil, fmt.Errorf("capturing logs is not supported on %s", runtime.GOOS)
 	}
-	scratch.Create()
-	return scratch
+	if err := scratch.Create(); err != nil {
+		return nil, fmt.Errorf("failed to create scratch disk: %v", err)
+	}
+	return scratch, nil
 }
+
 func (s *DarwinScratch) GetImg() string {
 	return s.img
 }
@@ -68,11 +79,45 @@ func (s *DarwinScratch) UnwrapToDir(dir string) error {
 	return deps.Binary("cp", "", "")("-r %s/* %s", mount, dir)
 }
 
+// LinuxScratch is a FAT32 image created and extracted in pure Go, so it does not require root, loop devices or mtools
+type LinuxScratch struct {
+	img string
+}
+
+func (s *LinuxScratch) GetImg() string {
+	return s.img
+}
+
+func (s *LinuxScratch) Create() error {
+	tmp, err := ioutil.TempFile("", "scratch*.img")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	s.img = tmp.Name()
+	logger.Infof("Creating %s", s.img)
+	return fat.Format(s.img, 100*1024*1024, scratchLabel)
+}
+
+func (s *LinuxScratch) UnwrapToDir(dir string) error {
+	defer os.Remove(s.img)
+	return fat.ExtractImage(s.img, dir)
+}
+
+const scratchLabel = "scratch"
+
+// MountScratchCommand mounts the scratch disk on /scratch, the Linux scratch disk is unpartitioned
+// while hdiutil creates a partitioned disk, so both are found by their label with a fallback to the device
+const MountScratchCommand = "mkdir -p /scratch && (mount -L SCRATCH /scratch || mount /dev/vdb /scratch || mount /dev/sdb1 /scratch || mount /dev/sdb /scratch)"
+
+// CaptureLogCommands copies the journal and cloud-init logs to the scratch disk, they ignore failures so
+// that as many logs as possible are captured from a failed build
 func CaptureLogCommands() []string {
 	return []string{
 		"mkdir -p /scratch",
 		"journalctl  -b --no-hostname -o short > /scratch/journal.log",
 		"cp -r /var/log/ /scratch || true",
 		"cp -r /var/lib/cloud/ /scratch || true",
+		"sync; umount /scratch || true",
 	}
 }
@@ -0,0 +1,191 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package fat creates and reads FAT filesystem images without requiring root, loop devices or mtools
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	sectorSize = 512
+	// reservedSectors includes the boot sector, FSInfo and their backups
+	reservedSectors = 32
+	numFATs         = 2
+	dirEntrySize    = 32
+
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+
+	// clusters below this limit are FAT16 (or FAT12) regardless of the boot sector
+	minFAT32Clusters = 65525
+	endOfChain       = 0x0FFFFFFF
+)
+
+// bpb is the BIOS parameter block at the start of the boot sector
+type bpb struct {
+	BytesPerSector    uint16
+	SectorsPerCluster uint8
+	ReservedSectors   uint16
+	NumFATs           uint8
+	RootEntries       uint16
+	TotalSectors16    uint16
+	Media             uint8
+	FATSize16         uint16
+	SectorsPerTrack   uint16
+	NumHeads          uint16
+	HiddenSectors     uint32
+	TotalSectors32    uint32
+}
+
+// fat32 is the extended FAT32 section of the boot sector that follows the bpb
+type fat32 struct {
+	FATSize32   uint32
+	ExtFlags    uint16
+	Version     uint16
+	RootCluster uint32
+	FSInfo      uint16
+	BackupBoot  uint16
+	Reserved    [12]byte
+	DriveNumber uint8
+	Reserved1   uint8
+	BootSig     uint8
+	VolumeID    uint32
+	VolumeLabel [11]byte
+	FSType      [8]byte
+}
+
+// Format creates an empty FAT32 filesystem image of size bytes with the specified volume label,
+// the filesystem is not partitioned so it can be mounted directly by its label.
+func Format(file string, size int64, label string) error {
+	totalSectors := size / sectorSize
+	// one sector clusters keep images down to ~33MB within the FAT32 cluster limit
+	clusters := totalSectors - reservedSectors
+	fatSectors := (clusters*4 + sectorSize - 1) / sectorSize
+	clusters = totalSectors - reservedSectors - numFATs*fatSectors
+	if clusters < minFAT32Clusters {
+		return fmt.Errorf("%d bytes is too small for a FAT32 filesystem", size)
+	}
+	if totalSectors > 0xFFFFFFFF {
+		return fmt.Errorf("%d bytes is too large for a FAT32 filesystem", size)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(totalSectors * sectorSize); err != nil {
+		return err
+	}
+
+	boot := make([]byte, sectorSize)
+	copy(boot, []byte{0xEB, 0x58, 0x90})
+	copy(boot[3:], "MSWIN4.1")
+	header := bpb{
+		BytesPerSector:    sectorSize,
+		SectorsPerCluster: 1,
+		ReservedSectors:   reservedSectors,
+		NumFATs:           numFATs,
+		Media:             0xF8,
+		SectorsPerTrack:   32,
+		NumHeads:          64,
+		TotalSectors32:    uint32(totalSectors),
+	}
+	ext := fat32{
+		FATSize32:   uint32(fatSectors),
+		RootCluster: 2,
+		FSInfo:      1,
+		BackupBoot:  6,
+		DriveNumber: 0x80,
+		BootSig:     0x29,
+		VolumeID:    rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+	}
+	copy(ext.VolumeLabel[:], shortLabel(label))
+	copy(ext.FSType[:], "FAT32   ")
+	put(boot[11:], header)
+	put(boot[36:], ext)
+	boot[510], boot[511] = 0x55, 0xAA
+
+	info := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+	// one cluster is used by the root directory
+	binary.LittleEndian.PutUint32(info[488:], uint32(clusters-1))
+	binary.LittleEndian.PutUint32(info[492:], 3)
+	binary.LittleEndian.PutUint32(info[508:], 0xAA550000)
+
+	for _, sector := range []int64{0, 6} {
+		if _, err := f.WriteAt(boot, sector*sectorSize); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(info, (sector+1)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	table := make([]byte, 12)
+	binary.LittleEndian.PutUint32(table[0:], 0x0FFFFF00|uint32(header.Media))
+	binary.LittleEndian.PutUint32(table[4:], endOfChain)
+	// the root directory occupies a single cluster
+	binary.LittleEndian.PutUint32(table[8:], endOfChain)
+	for i := int64(0); i < numFATs; i++ {
+		if _, err := f.WriteAt(table, (reservedSectors+i*fatSectors)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	root := make([]byte, dirEntrySize)
+	copy(root, shortLabel(label))
+	root[11] = attrVolumeID
+	_, err = f.WriteAt(root, (reservedSectors+numFATs*fatSectors)*sectorSize)
+	return err
+}
+
+// shortLabel returns the label as an upper case, space padded 11 byte volume label
+func shortLabel(label string) string {
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		label = label[:11]
+	}
+	return fmt.Sprintf("%-11s", label)
+}
+
+func put(b []byte, v interface{}) {
+	w := &sliceWriter{b: b}
+	binary.Write(w, binary.LittleEndian, v) // nolint: errcheck
+}
+
+type sliceWriter struct {
+	b []byte
+}
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	n := copy(w.b, p)
+	w.b = w.b[n:]
+	return n, nil
+}
@@ -0,0 +1,351 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FileSystem is a read only FAT12, FAT16 or FAT32 filesystem
+type FileSystem struct {
+	r           io.ReaderAt
+	bpb         bpb
+	bits        int
+	fatOffset   int64
+	dataOffset  int64
+	rootOffset  int64
+	rootCluster uint32
+	clusterSize int64
+}
+
+// Entry is a file or directory in a FileSystem
+type Entry struct {
+	Name     string
+	Dir      bool
+	Size     int64
+	Modified time.Time
+	cluster  uint32
+}
+
+// Open reads the filesystem in r, which must start with the boot sector
+func Open(r io.ReaderAt) (*FileSystem, error) {
+	boot := make([]byte, sectorSize)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if boot[510] != 0x55 || boot[511] != 0xAA {
+		return nil, fmt.Errorf("not a FAT filesystem: missing boot signature")
+	}
+	fs := &FileSystem{r: r}
+	if err := binary.Read(bytes.NewReader(boot[11:]), binary.LittleEndian, &fs.bpb); err != nil {
+		return nil, err
+	}
+	b := fs.bpb
+	if b.BytesPerSector == 0 || b.SectorsPerCluster == 0 || b.NumFATs == 0 {
+		return nil, fmt.Errorf("not a FAT filesystem: invalid BIOS parameter block")
+	}
+	fatSize := uint32(b.FATSize16)
+	var ext fat32
+	if fatSize == 0 {
+		if err := binary.Read(bytes.NewReader(boot[36:]), binary.LittleEndian, &ext); err != nil {
+			return nil, err
+		}
+		fatSize = ext.FATSize32
+	}
+	totalSectors := uint32(b.TotalSectors16)
+	if totalSectors == 0 {
+		totalSectors = b.TotalSectors32
+	}
+	sector := int64(b.BytesPerSector)
+	rootSectors := (int64(b.RootEntries)*dirEntrySize + sector - 1) / sector
+	fs.fatOffset = int64(b.ReservedSectors) * sector
+	fs.rootOffset = fs.fatOffset + int64(b.NumFATs)*int64(fatSize)*sector
+	fs.dataOffset = fs.rootOffset + rootSectors*sector
+	fs.clusterSize = int64(b.SectorsPerCluster) * sector
+
+	clusters := (int64(totalSectors)*sector - fs.dataOffset) / fs.clusterSize
+	switch {
+	case b.FATSize16 == 0:
+		fs.bits = 32
+		fs.rootCluster = ext.RootCluster
+	case clusters < 4085:
+		fs.bits = 12
+	default:
+		fs.bits = 16
+	}
+	return fs, nil
+}
+
+// next returns the cluster following cluster in its chain, or 0 at the end of the chain
+func (fs *FileSystem) next(cluster uint32) (uint32, error) {
+	buf := make([]byte, 4)
+	var next uint32
+	switch fs.bits {
+	case 32:
+		if _, err := fs.r.ReadAt(buf, fs.fatOffset+int64(cluster)*4); err != nil {
+			return 0, err
+		}
+		next = binary.LittleEndian.Uint32(buf) & 0x0FFFFFFF
+		if next >= 0x0FFFFFF8 {
+			return 0, nil
+		}
+	case 16:
+		if _, err := fs.r.ReadAt(buf[:2], fs.fatOffset+int64(cluster)*2); err != nil {
+			return 0, err
+		}
+		next = uint32(binary.LittleEndian.Uint16(buf))
+		if next >= 0xFFF8 {
+			return 0, nil
+		}
+	default:
+		if _, err := fs.r.ReadAt(buf[:2], fs.fatOffset+int64(cluster)*3/2); err != nil {
+			return 0, err
+		}
+		next = uint32(binary.LittleEndian.Uint16(buf))
+		if cluster%2 == 1 {
+			next >>= 4
+		}
+		next &= 0xFFF
+		if next >= 0xFF8 {
+			return 0, nil
+		}
+	}
+	if next < 2 {
+		return 0, fmt.Errorf("corrupt cluster chain at cluster %d", cluster)
+	}
+	return next, nil
+}
+
+// readChain reads the clusters starting at cluster, limited to size bytes if size is not negative
+func (fs *FileSystem) readChain(cluster uint32, size int64, w io.Writer) error {
+	buf := make([]byte, fs.clusterSize)
+	// guard against loops in a corrupt chain
+	for visited := 0; cluster != 0 && size != 0; visited++ {
+		if int64(visited)*fs.clusterSize > 1<<32 {
+			return fmt.Errorf("cluster chain is too long")
+		}
+		n := fs.clusterSize
+		if size >= 0 && size < n {
+			n = size
+		}
+		if _, err := fs.r.ReadAt(buf[:n], fs.dataOffset+int64(cluster-2)*fs.clusterSize); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		if size > 0 {
+			size -= n
+		}
+		var err error
+		if cluster, err = fs.next(cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadDir lists a directory, the root directory is read when dir is nil
+func (fs *FileSystem) ReadDir(dir *Entry) ([]Entry, error) {
+	var data []byte
+	if dir == nil && fs.bits != 32 {
+		data = make([]byte, int64(fs.bpb.RootEntries)*dirEntrySize)
+		if _, err := fs.r.ReadAt(data, fs.rootOffset); err != nil {
+			return nil, err
+		}
+	} else {
+		cluster := fs.rootCluster
+		if dir != nil {
+			cluster = dir.cluster
+		}
+		var buf bytes.Buffer
+		if err := fs.readChain(cluster, -1, &buf); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	return parseDir(data), nil
+}
+
+// parseDir decodes directory entries, combining long file name entries with their short entry
+func parseDir(data []byte) []Entry {
+	var entries []Entry
+	var long []uint16
+	var checksum byte
+	for i := 0; i+dirEntrySize <= len(data); i += dirEntrySize {
+		raw := data[i : i+dirEntrySize]
+		if raw[0] == 0x00 {
+			break
+		}
+		if raw[0] == 0xE5 {
+			long = nil
+			continue
+		}
+		attr := raw[11]
+		if attr&attrLongName == attrLongName {
+			order := int(raw[0] & 0x1F)
+			if raw[0]&0x40 != 0 {
+				long = make([]uint16, order*13)
+				checksum = raw[13]
+			}
+			if order == 0 || order*13 > len(long) || raw[13] != checksum {
+				long = nil
+				continue
+			}
+			var chars []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for j := r[0]; j < r[1]; j += 2 {
+					chars = append(chars, binary.LittleEndian.Uint16(raw[j:]))
+				}
+			}
+			copy(long[(order-1)*13:], chars)
+			continue
+		}
+		if attr&attrVolumeID != 0 {
+			long = nil
+			continue
+		}
+		name := shortName(raw)
+		if long != nil && lfnChecksum(raw[:11]) == checksum {
+			name = longName(long)
+		}
+		long = nil
+		if name == "." || name == ".." {
+			continue
+		}
+		entries = append(entries, Entry{
+			Name:     name,
+			Dir:      attr&attrDirectory != 0,
+			Size:     int64(binary.LittleEndian.Uint32(raw[28:])),
+			Modified: fatTime(binary.LittleEndian.Uint16(raw[24:]), binary.LittleEndian.Uint16(raw[22:])),
+			cluster:  uint32(binary.LittleEndian.Uint16(raw[20:]))<<16 | uint32(binary.LittleEndian.Uint16(raw[26:])),
+		})
+	}
+	return entries
+}
+
+// shortName decodes an 8.3 name, applying the lower case flags set by Windows NT and Linux
+func shortName(raw []byte) string {
+	base := strings.TrimRight(string(raw[0:8]), " ")
+	ext := strings.TrimRight(string(raw[8:11]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "\xE5" + base[1:]
+	}
+	if raw[12]&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if raw[12]&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func longName(chars []uint16) string {
+	for i, c := range chars {
+		if c == 0 || c == 0xFFFF {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+func lfnChecksum(name []byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+func fatTime(date, t uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0x0F), int(date&0x1F),
+		int(t>>11), int(t>>5&0x3F), int(t&0x1F)*2, 0, time.Local)
+}
+
+// Extract copies every file and directory in the filesystem to dir
+func (fs *FileSystem) Extract(dir string) error {
+	return fs.extract(nil, dir)
+}
+
+func (fs *FileSystem) extract(parent *Entry, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(parent)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entry := entry
+		if strings.ContainsAny(entry.Name, `/\`) {
+			return fmt.Errorf("invalid file name %s", entry.Name)
+		}
+		target := filepath.Join(dir, entry.Name)
+		if entry.Dir {
+			if err := fs.extract(&entry, target); err != nil {
+				return err
+			}
+		} else if err := fs.extractFile(entry, target); err != nil {
+			return err
+		}
+		if !entry.Modified.IsZero() {
+			os.Chtimes(target, entry.Modified, entry.Modified) // nolint: errcheck
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) extractFile(entry Entry, target string) error {
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if entry.Size == 0 {
+		return nil
+	}
+	return fs.readChain(entry.cluster, entry.Size, f)
+}
+
+// ExtractImage copies the contents of a FAT filesystem image to dir
+func ExtractImage(image, dir string) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fs, err := Open(f)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", image, err)
+	}
+	return fs.Extract(dir)
+}
@@ -0,0 +1,326 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// node is a file or directory to be written, along with the clusters allocated to it
+type node struct {
+	name     string
+	data     []byte
+	dir      bool
+	children []*node
+	clusters []uint32
+}
+
+type writer struct {
+	f          *os.File
+	fs         *FileSystem
+	fat        []byte
+	fatSize    int64
+	next       uint32
+	maxCluster uint32
+	modified   time.Time
+	label      string
+	shortNames map[*node][11]byte
+	needsLong  map[*node]bool
+}
+
+// Create formats file as a FAT32 filesystem of size bytes and writes files to it, files are keyed
+// by their slash separated path and any parent directories are created.
+func Create(file string, size int64, label string, files map[string][]byte) error {
+	if err := Format(file, size, label); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fs, err := Open(f)
+	if err != nil {
+		return err
+	}
+
+	root := &node{dir: true}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := root.add(strings.Split(strings.Trim(path, "/"), "/"), files[path]); err != nil {
+			return err
+		}
+	}
+
+	w := &writer{
+		f:          f,
+		fs:         fs,
+		fatSize:    (fs.dataOffset - fs.fatOffset) / int64(fs.bpb.NumFATs),
+		next:       3,
+		modified:   time.Now(),
+		label:      label,
+		shortNames: make(map[*node][11]byte),
+		needsLong:  make(map[*node]bool),
+	}
+	w.maxCluster = uint32((int64(fs.bpb.TotalSectors32)*sectorSize-fs.dataOffset)/fs.clusterSize) + 1
+	w.fat = make([]byte, w.fatSize)
+	if _, err := f.ReadAt(w.fat, fs.fatOffset); err != nil {
+		return err
+	}
+	root.clusters = []uint32{fs.rootCluster}
+	if err := w.allocate(root, true); err != nil {
+		return err
+	}
+	if err := w.write(root, nil); err != nil {
+		return err
+	}
+	for i := int64(0); i < int64(fs.bpb.NumFATs); i++ {
+		if _, err := f.WriteAt(w.fat, fs.fatOffset+i*w.fatSize); err != nil {
+			return err
+		}
+	}
+	return w.updateInfo()
+}
+
+// add inserts a file at path below n, creating any missing directories
+func (n *node) add(path []string, data []byte) error {
+	for _, child := range n.children {
+		if !strings.EqualFold(child.name, path[0]) {
+			continue
+		}
+		if len(path) == 1 || !child.dir {
+			return fmt.Errorf("duplicate file %s", strings.Join(path, "/"))
+		}
+		return child.add(path[1:], data)
+	}
+	if len(path) == 1 {
+		n.children = append(n.children, &node{name: path[0], data: data})
+		return nil
+	}
+	child := &node{name: path[0], dir: true}
+	n.children = append(n.children, child)
+	return child.add(path[1:], data)
+}
+
+// allocate assigns short names and clusters to n and its children
+func (w *writer) allocate(n *node, root bool) error {
+	size := int64(len(n.data))
+	if n.dir {
+		used := make(map[[11]byte]bool)
+		// the volume label, or the . and .. entries
+		entries := 1
+		if !root {
+			entries = 2
+		}
+		for _, child := range n.children {
+			short, long := shortName83(child.name, used)
+			used[short] = true
+			w.shortNames[child] = short
+			w.needsLong[child] = long
+			entries++
+			if long {
+				entries += (len(utf16.Encode([]rune(child.name))) + 13) / 13
+			}
+		}
+		size = int64(entries) * dirEntrySize
+	}
+	count := (size + w.fs.clusterSize - 1) / w.fs.clusterSize
+	for int64(len(n.clusters)) < count {
+		if w.next > w.maxCluster {
+			return fmt.Errorf("not enough space for %s", n.name)
+		}
+		n.clusters = append(n.clusters, w.next)
+		w.next++
+	}
+	for i, cluster := range n.clusters {
+		next := uint32(endOfChain)
+		if i+1 < len(n.clusters) {
+			next = n.clusters[i+1]
+		}
+		binary.LittleEndian.PutUint32(w.fat[cluster*4:], next)
+	}
+	for _, child := range n.children {
+		if err := w.allocate(child, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes the directory entries and data of n and its children
+func (w *writer) write(n *node, parent *node) error {
+	data := n.data
+	if n.dir {
+		var entries []byte
+		if parent == nil {
+			entries = append(entries, w.entry([11]byte{}, attrVolumeID, 0, 0)...)
+			copy(entries, shortLabel(w.label))
+		} else {
+			var dot, dotdot [11]byte
+			copy(dot[:], ".          ")
+			copy(dotdot[:], "..         ")
+			entries = append(entries, w.entry(dot, attrDirectory, n.clusters[0], 0)...)
+			parentCluster := uint32(0)
+			if parent.clusters[0] != w.fs.rootCluster {
+				parentCluster = parent.clusters[0]
+			}
+			entries = append(entries, w.entry(dotdot, attrDirectory, parentCluster, 0)...)
+		}
+		for _, child := range n.children {
+			short := w.shortNames[child]
+			if w.needsLong[child] {
+				entries = append(entries, longEntries(child.name, lfnChecksum(short[:]))...)
+			}
+			attr, first := byte(attrArchive), uint32(0)
+			if child.dir {
+				attr = attrDirectory
+			}
+			if len(child.clusters) > 0 {
+				first = child.clusters[0]
+			}
+			entries = append(entries, w.entry(short, attr, first, uint32(len(child.data)))...)
+		}
+		data = entries
+	}
+	// pad the last cluster so that directories are terminated by a zero entry
+	buf := make([]byte, int64(len(n.clusters))*w.fs.clusterSize)
+	copy(buf, data)
+	for i, cluster := range n.clusters {
+		chunk := buf[int64(i)*w.fs.clusterSize : int64(i+1)*w.fs.clusterSize]
+		if _, err := w.f.WriteAt(chunk, w.fs.dataOffset+int64(cluster-2)*w.fs.clusterSize); err != nil {
+			return err
+		}
+	}
+	for _, child := range n.children {
+		if err := w.write(child, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry returns a short directory entry
+func (w *writer) entry(name [11]byte, attr byte, cluster uint32, size uint32) []byte {
+	raw := make([]byte, dirEntrySize)
+	copy(raw, name[:])
+	raw[11] = attr
+	date := uint16(w.modified.Year()-1980)<<9 | uint16(w.modified.Month())<<5 | uint16(w.modified.Day())
+	t := uint16(w.modified.Hour())<<11 | uint16(w.modified.Minute())<<5 | uint16(w.modified.Second()/2)
+	binary.LittleEndian.PutUint16(raw[14:], t)
+	binary.LittleEndian.PutUint16(raw[16:], date)
+	binary.LittleEndian.PutUint16(raw[18:], date)
+	binary.LittleEndian.PutUint16(raw[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(raw[22:], t)
+	binary.LittleEndian.PutUint16(raw[24:], date)
+	binary.LittleEndian.PutUint16(raw[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(raw[28:], size)
+	return raw
+}
+
+// longEntries returns the long file name entries that precede the short entry, in the order they are stored
+func longEntries(name string, checksum byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xFFFF)
+	}
+	count := len(chars) / 13
+	var entries []byte
+	for order := count; order >= 1; order-- {
+		raw := make([]byte, dirEntrySize)
+		raw[0] = byte(order)
+		if order == count {
+			raw[0] |= 0x40
+		}
+		raw[11] = attrLongName
+		raw[13] = checksum
+		part := chars[(order-1)*13 : order*13]
+		i := 0
+		for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+			for j := r[0]; j < r[1]; j += 2 {
+				binary.LittleEndian.PutUint16(raw[j:], part[i])
+				i++
+			}
+		}
+		entries = append(entries, raw...)
+	}
+	return entries
+}
+
+// shortName83 returns a unique 8.3 name for name, and whether a long file name entry is needed to store name
+func shortName83(name string, used map[[11]byte]bool) ([11]byte, bool) {
+	var short [11]byte
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	clean := func(s string, max int) string {
+		var out []byte
+		for _, c := range []byte(strings.ToUpper(s)) {
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("$%'-_@~`!(){}^#&", c) >= 0 {
+				out = append(out, c)
+			}
+		}
+		if len(out) > max {
+			out = out[:max]
+		}
+		return string(out)
+	}
+	copy(short[:], fmt.Sprintf("%-8s%-3s", clean(base, 8), clean(ext, 3)))
+	if clean(base, 8) == base && clean(ext, 3) == ext && base != "" && !used[short] {
+		return short, false
+	}
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf("~%d", i)
+		b := clean(base, 8-len(suffix))
+		if b == "" {
+			b = "_"
+		}
+		copy(short[:], fmt.Sprintf("%-8s%-3s", b+suffix, clean(ext, 3)))
+		if !used[short] {
+			return short, true
+		}
+	}
+}
+
+// updateInfo updates the free cluster count and next free cluster hint in the FSInfo sectors
+func (w *writer) updateInfo() error {
+	info := make([]byte, sectorSize)
+	for _, sector := range []int64{1, 7} {
+		if _, err := w.f.ReadAt(info, sector*sectorSize); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(info[488:], w.maxCluster-w.next+1)
+		binary.LittleEndian.PutUint32(info[492:], w.next)
+		if _, err := w.f.WriteAt(info, sector*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
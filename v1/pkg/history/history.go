@@ -0,0 +1,247 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package history persists a JSON record of every build to a local state directory
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/utils"
+	"sigs.k8s.io/image-builder/api"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Image is a snapshot of an api.Image at a point in the build
+type Image struct {
+	Kind  string `json:"kind"`
+	Image string `json:"image"`
+	// Spec is the full image definition, it is decoded as a map when read back
+	Spec interface{} `json:"spec,omitempty"`
+}
+
+// Artifact is an output of the build, local files include their size and digest
+type Artifact struct {
+	Image
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Step records the timing of a single phase of the build, e.g. configure or convert
+type Step struct {
+	Name     string        `json:"name"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Record describes a single run of image-builder build
+type Record struct {
+	ID          string        `json:"id"`
+	Status      string        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+	Started     time.Time     `json:"started"`
+	Duration    time.Duration `json:"duration"`
+	ConfigFiles []string      `json:"config_files"`
+	ConfigHash  string        `json:"config_hash"`
+	Distro      string        `json:"distro"`
+	Engine      string        `json:"engine"`
+	Input       *Image        `json:"input,omitempty"`
+	Configured  *Image        `json:"configured,omitempty"`
+	// Chain is the list of converters that were run, e.g. img->vmdk
+	Chain   []string   `json:"chain,omitempty"`
+	Outputs []Artifact `json:"outputs,omitempty"`
+	Steps   []Step     `json:"steps,omitempty"`
+}
+
+// Dir returns the directory build records are stored in
+func Dir(stateDir string) string {
+	if stateDir == "" {
+		home, _ := os.UserHomeDir()
+		stateDir = path.Join(home, ".image-builder")
+	}
+	return path.Join(stateDir, "builds")
+}
+
+// New creates a running record, hashing the config files and any overrides
+func New(configFiles []string, extras []string) (*Record, error) {
+	hash := sha256.New()
+	for _, file := range configFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(hash, "%s\n", path.Base(file))
+		hash.Write(data)
+	}
+	for _, extra := range extras {
+		fmt.Fprintf(hash, "%s\n", extra)
+	}
+	now := time.Now()
+	return &Record{
+		ID:          now.Format("20060102-150405") + "-" + utils.RandomString(4),
+		Status:      StatusRunning,
+		Started:     now,
+		ConfigFiles: configFiles,
+		ConfigHash:  fmt.Sprintf("%x", hash.Sum(nil)),
+	}, nil
+}
+
+// NewImage returns a snapshot of image, or nil if there is no image
+func NewImage(image api.Image) *Image {
+	if image == nil {
+		return nil
+	}
+	return &Image{Kind: image.Kind(), Image: image.String(), Spec: image}
+}
+
+// Step runs fn, recording how long it took and whether it failed
+func (r *Record) Step(name string, fn func() error) error {
+	step := Step{Name: name, Started: time.Now()}
+	err := fn()
+	step.Duration = time.Since(step.Started)
+	if err != nil {
+		step.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, step)
+	return err
+}
+
+// AddOutput records an output image, if the image refers to a local file its size and sha256 are included
+func (r *Record) AddOutput(image api.Image) error {
+	artifact := Artifact{Image: *NewImage(image)}
+	info, err := os.Stat(image.String())
+	if err != nil || info.IsDir() {
+		r.Outputs = append(r.Outputs, artifact)
+		return nil
+	}
+	artifact.Path = image.String()
+	artifact.Size = info.Size()
+	f, err := os.Open(artifact.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	artifact.SHA256 = fmt.Sprintf("%x", hash.Sum(nil))
+	r.Outputs = append(r.Outputs, artifact)
+	return nil
+}
+
+// Finish marks the record as complete and saves it to dir
+func (r *Record) Finish(dir string, err error) error {
+	r.Duration = time.Since(r.Started)
+	r.Status = StatusSucceeded
+	if err != nil {
+		r.Status = StatusFailed
+		r.Error = err.Error()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path.Join(dir, r.ID+".json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.Encode(f)
+}
+
+// Encode writes the record as indented JSON to w
+func (r *Record) Encode(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// List returns all records in dir, most recent first
+func List(dir string) ([]Record, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		record, err := load(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Started.After(records[j].Started) })
+	return records, nil
+}
+
+// Get returns the record with the specified ID, or unique ID prefix
+func Get(dir, id string) (*Record, error) {
+	records, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found []Record
+	for _, record := range records {
+		if record.ID == id {
+			return &record, nil
+		}
+		if strings.HasPrefix(record.ID, id) {
+			found = append(found, record)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("build %s not found in %s", id, dir)
+	case 1:
+		return &found[0], nil
+	}
+	return nil, fmt.Errorf("build id %s is ambiguous, matches %d builds", id, len(found))
+}
+
+func load(file string) (*Record, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	record := &Record{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("invalid build record %s: %v", file, err)
+	}
+	return record, nil
+}
@@ -0,0 +1,49 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package history
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/image-builder/api"
+)
+
+// TestRegistryCredentials checks that registry credentials are not written to the build history
+func TestRegistryCredentials(t *testing.T) {
+	record := &Record{ID: "test"}
+	image := api.Registry{
+		Repository: "registry.example.com/team/image",
+		Username:   "builder",
+		Password:   "hunter2",
+		Digest:     "sha256:abc",
+	}
+	if err := record.AddOutput(image); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := record.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "hunter2") || strings.Contains(buf.String(), "builder") {
+		t.Errorf("credentials were recorded: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "sha256:abc") {
+		t.Errorf("digest was not recorded: %s", buf.String())
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Archive is an OCI image layout tarball opened for reading
+type Archive struct {
+	f       *os.File
+	entries map[string]*io.SectionReader
+}
+
+// countingReader tracks the offset in the archive of each tar entry
+type countingReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+// OpenArchive indexes the files in an OCI image layout tarball
+func OpenArchive(file string) (*Archive, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	archive := &Archive{f: f, entries: make(map[string]*io.SectionReader)}
+	counter := &countingReader{r: f}
+	tr := tar.NewReader(counter)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			archive.entries[path.Clean(strings.TrimPrefix(header.Name, "./"))] = io.NewSectionReader(f, counter.offset, header.Size)
+		}
+	}
+	if _, ok := archive.entries["index.json"]; !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s is not an OCI image layout: missing index.json", file)
+	}
+	return archive, nil
+}
+
+// Close closes the underlying file
+func (a *Archive) Close() error {
+	return a.f.Close()
+}
+
+// Open returns the contents of a file in the layout
+func (a *Archive) Open(name string) (*io.SectionReader, error) {
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	return io.NewSectionReader(entry, 0, entry.Size()), nil
+}
+
+// Blob returns the contents of the blob with digest
+func (a *Archive) Blob(digest string) (*io.SectionReader, error) {
+	return a.Open(blobPath(digest))
+}
+
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func (a *Archive) readJSON(name string, v interface{}) error {
+	r, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+// Index returns the top level index of the layout
+func (a *Archive) Index() (Index, error) {
+	var index Index
+	err := a.readJSON("index.json", &index)
+	return index, err
+}
+
+// Manifest returns the image manifest with digest
+func (a *Archive) Manifest(digest string) (Manifest, error) {
+	var manifest Manifest
+	err := a.readJSON(blobPath(digest), &manifest)
+	return manifest, err
+}
+
+// Manifests returns the descriptors of every image manifest in the layout, nested indexes
+// such as those written by docker buildx for multi-platform images are followed
+func (a *Archive) Manifests() ([]Descriptor, error) {
+	index, err := a.Index()
+	if err != nil {
+		return nil, err
+	}
+	return a.manifests(index.Manifests, 0)
+}
+
+func (a *Archive) manifests(descriptors []Descriptor, depth int) ([]Descriptor, error) {
+	if depth > 8 {
+		return nil, fmt.Errorf("index is nested too deeply")
+	}
+	var manifests []Descriptor
+	for _, desc := range descriptors {
+		if desc.MediaType != MediaTypeIndex && desc.MediaType != MediaTypeDockerManifestList {
+			manifests = append(manifests, desc)
+			continue
+		}
+		var index Index
+		if err := a.readJSON(blobPath(desc.Digest), &index); err != nil {
+			return nil, err
+		}
+		nested, err := a.manifests(index.Manifests, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, nested...)
+	}
+	return manifests, nil
+}
+
+// Image returns the manifest of the image for platform, a layout with a single image that does not
+// specify its platform is assumed to match
+func (a *Archive) Image(platform Platform) (Manifest, error) {
+	manifests, err := a.Manifests()
+	if err != nil {
+		return Manifest{}, err
+	}
+	desc, err := Index{Manifests: manifests}.Find(platform)
+	if err != nil && len(manifests) == 1 && manifests[0].Platform == nil {
+		desc, err = manifests[0], nil
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	return a.Manifest(desc.Digest)
+}
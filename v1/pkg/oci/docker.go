@@ -0,0 +1,136 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// dockerManifest is an entry in the manifest.json of a docker save archive
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// FromDockerArchive converts the first image in a docker save archive into an OCI layout written to w,
+// tagged as ref. The layers and config are unchanged so the image ID is preserved.
+func FromDockerArchive(archive string, w io.Writer, ref string) (Descriptor, error) {
+	dir, err := ioutil.TempDir("", "image-builder-oci")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.RemoveAll(dir)
+	if err := untar(archive, dir); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to read %s: %v", archive, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("%s is not a docker archive: %v", archive, err)
+	}
+	var manifests []dockerManifest
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return Descriptor{}, fmt.Errorf("invalid manifest.json in %s: %v", archive, err)
+	}
+	if len(manifests) == 0 {
+		return Descriptor{}, fmt.Errorf("no images found in %s", archive)
+	}
+
+	layout := NewLayout(w)
+	manifest := manifests[0]
+	config, err := layout.AddBlobFile(MediaTypeConfig, filepath.Join(dir, manifest.Config))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	var layers []Descriptor
+	for _, layer := range manifest.Layers {
+		file := filepath.Join(dir, layer)
+		mediaType, err := layerMediaType(file)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		desc, err := layout.AddBlobFile(mediaType, file)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		layers = append(layers, desc)
+	}
+	desc, err := layout.AddManifest(config, layers, ref, nil)
+	if err != nil {
+		return desc, err
+	}
+	return desc, layout.Close()
+}
+
+// layerMediaType returns the media type of a layer, docker saves layers uncompressed but accepts compressed layers on load
+func layerMediaType(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic, _ := bufio.NewReader(f).Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return MediaTypeLayerGzip, nil
+	}
+	return MediaTypeLayer, nil
+}
+
+// untar extracts the regular files of archive into dir
+func untar(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean("/" + header.Name)
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package oci reads and writes container images in the OCI image layout format
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// MediaTypeDockerManifestList is the docker equivalent of an index
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// AnnotationRefName is the tag of a manifest in the index
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// Platform is the operating system and architecture an image runs on
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// Descriptor references a blob by its digest
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Manifest is an OCI image manifest
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Index lists the manifests in a layout
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Layout writes an OCI image layout as a tar archive, blobs are written as they are added and the
+// index is written on Close. Timestamps are fixed so that the same image always produces the same archive.
+type Layout struct {
+	tw        *tar.Writer
+	blobs     map[string]bool
+	manifests []Descriptor
+}
+
+// NewLayout returns a Layout that writes to w
+func NewLayout(w io.Writer) *Layout {
+	return &Layout{tw: tar.NewWriter(w), blobs: make(map[string]bool)}
+}
+
+func (l *Layout) write(name string, size int64, r io.Reader) error {
+	if err := l.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(l.tw, r)
+	return err
+}
+
+// AddBlob adds data to the layout, returning its descriptor
+func (l *Layout) AddBlob(mediaType string, data []byte) (Descriptor, error) {
+	desc := Descriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:      int64(len(data)),
+	}
+	if l.blobs[desc.Digest] {
+		return desc, nil
+	}
+	l.blobs[desc.Digest] = true
+	return desc, l.write("blobs/sha256/"+desc.Digest[7:], desc.Size, bytes.NewReader(data))
+}
+
+// AddBlobFile adds the contents of file to the layout, returning its descriptor
+func (l *Layout) AddBlobFile(mediaType, file string) (Descriptor, error) {
+	desc, err := Digest(file)
+	if err != nil {
+		return desc, err
+	}
+	desc.MediaType = mediaType
+	if l.blobs[desc.Digest] {
+		return desc, nil
+	}
+	l.blobs[desc.Digest] = true
+	f, err := os.Open(file)
+	if err != nil {
+		return desc, err
+	}
+	defer f.Close()
+	return desc, l.write("blobs/sha256/"+desc.Digest[7:], desc.Size, f)
+}
+
+// AddManifest adds a manifest of config and layers to the layout and its index, tagged as ref if not empty
+func (l *Layout) AddManifest(config Descriptor, layers []Descriptor, ref string, platform *Platform) (Descriptor, error) {
+	data, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        config,
+		Layers:        layers,
+	})
+	if err != nil {
+		return Descriptor{}, err
+	}
+	desc, err := l.AddBlob(MediaTypeManifest, data)
+	if err != nil {
+		return desc, err
+	}
+	desc.Platform = platform
+	if ref != "" {
+		desc.Annotations = map[string]string{AnnotationRefName: ref}
+	}
+	l.manifests = append(l.manifests, desc)
+	return desc, nil
+}
+
+// Close writes the oci-layout and index.json files and closes the archive
+func (l *Layout) Close() error {
+	layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	if err := l.write("oci-layout", int64(len(layout)), bytes.NewReader(layout)); err != nil {
+		return err
+	}
+	index, err := json.Marshal(Index{SchemaVersion: 2, MediaType: MediaTypeIndex, Manifests: l.manifests})
+	if err != nil {
+		return err
+	}
+	if err := l.write("index.json", int64(len(index)), bytes.NewReader(index)); err != nil {
+		return err
+	}
+	return l.tw.Close()
+}
+
+// Digest returns a descriptor with the sha256 digest and size of file
+func Digest(file string) (Descriptor, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{Digest: fmt.Sprintf("sha256:%x", hash.Sum(nil)), Size: size}, nil
+}
+
+// Find returns the manifest in the index for platform, an empty variant matches any variant
+func (index Index) Find(platform Platform) (Descriptor, error) {
+	for _, desc := range index.Manifests {
+		if desc.Platform == nil || desc.Platform.OS != platform.OS || desc.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant == "" || desc.Platform.Variant == platform.Variant {
+			return desc, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no image found for %s", platform)
+}
+
+// BlobName returns a file name for the blob with digest
+func BlobName(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
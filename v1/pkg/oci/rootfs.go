@@ -0,0 +1,359 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// SafePath returns the location of name inside root, failing if any parent directory of name is a
+// symlink, as following it could escape root
+func SafePath(root, name string) (string, error) {
+	name = path.Clean("/" + name)
+	target := root
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		target = filepath.Join(target, part)
+		if i == len(parts)-1 {
+			break
+		}
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symlink", path.Join(parts[:i+1]...))
+		}
+	}
+	return target, nil
+}
+
+// decompress returns an uncompressed reader for a layer that is either a plain or gzipped tar
+func decompress(r io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(r)
+	magic, _ := buf.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buf)
+	}
+	return buf, nil
+}
+
+// Unpack extracts a layer into root, applying any whiteouts to the files of previous layers. Ownership is only
+// restored when running as root, and device nodes are skipped as they are provided by the container runtime.
+func Unpack(layer io.Reader, root string) error {
+	r, err := decompress(layer)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	extracted := make(map[string]bool)
+	type dirTimes struct {
+		path  string
+		mode  os.FileMode
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		base, dir := path.Base(name), path.Dir(name)
+		if base == whiteoutOpaque {
+			if err := removeChildren(root, dir, extracted); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := SafePath(root, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		target, err := SafePath(root, name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		mode := os.FileMode(header.Mode) & os.ModePerm
+		if header.Mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if header.Mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if header.Mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+		if info, err := os.Lstat(target); err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// directories are writable until every file has been extracted
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode|0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{target, mode, header.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := SafePath(root, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		default:
+			logger.Debugf("Skipping %s of type %c", name, header.Typeflag)
+			continue
+		}
+		extracted[name] = true
+
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+				return err
+			}
+		}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+			os.Chtimes(target, header.ModTime, header.ModTime) // nolint: errcheck
+		}
+	}
+	// parents are restored after their children, as restoring the mode could prevent further changes
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chmod(dirs[i].path, dirs[i].mode)                   // nolint: errcheck
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime) // nolint: errcheck
+	}
+	return nil
+}
+
+// removeChildren removes the files in dir that were not extracted from the current layer
+func removeChildren(root, dir string, extracted map[string]bool) error {
+	target, err := SafePath(root, dir)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if extracted[path.Join(dir, entry.Name())] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(target, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileState is used to detect changes to a file
+type fileState struct {
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+	uid     uint32
+	gid     uint32
+	ino     uint64
+	link    string
+}
+
+// Snapshot records the state of each file in a rootfs, so that changes can be found using Diff
+type Snapshot map[string]fileState
+
+func stat(file string, info os.FileInfo) fileState {
+	state := fileState{mode: info.Mode(), size: info.Size(), modTime: info.ModTime()}
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		state.uid, state.gid, state.ino = sys.Uid, sys.Gid, uint64(sys.Ino)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		state.link, _ = os.Readlink(file)
+	}
+	if info.IsDir() {
+		// a directory is only included in a diff if its own attributes change, not its contents
+		state.size = 0
+		state.modTime = time.Time{}
+	}
+	return state
+}
+
+// TakeSnapshot records the state of every file under root
+func TakeSnapshot(root string) (Snapshot, error) {
+	snapshot := make(Snapshot)
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, file)
+		snapshot[filepath.ToSlash(rel)] = stat(file, info)
+		return nil
+	})
+	return snapshot, err
+}
+
+// Diff writes an uncompressed layer to w containing the files under root that were added or changed since before,
+// and a whiteout for each file that was removed
+func Diff(root string, before Snapshot, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	after := make(Snapshot)
+	links := make(map[uint64]string)
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, file)
+		rel = filepath.ToSlash(rel)
+		// sockets cannot be stored in a layer
+		if rel == "." || info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		state := stat(file, info)
+		after[rel] = state
+		if previous, ok := before[rel]; ok && previous == state {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, state.link)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		// as with Unpack, ownership is only preserved when running as root, otherwise files are owned by root
+		if os.Geteuid() == 0 {
+			header.Uid, header.Gid = int(state.uid), int(state.gid)
+		} else {
+			header.Uid, header.Gid = 0, 0
+		}
+		header.Uname, header.Gname = "", ""
+		if info.Mode().IsRegular() && state.ino != 0 {
+			if first, ok := links[state.ino]; ok {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first, 0
+			} else {
+				links[state.ino] = rel
+			}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	for rel := range before {
+		if _, ok := after[rel]; !ok && rel != "." {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Strings(removed)
+	for _, rel := range removed {
+		// only the top most directory that was removed needs a whiteout
+		if _, ok := before[path.Dir(rel)]; ok && path.Dir(rel) != "." {
+			if _, exists := after[path.Dir(rel)]; !exists {
+				continue
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     path.Join(path.Dir(rel), whiteoutPrefix+path.Base(rel)),
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			ModTime:  time.Now(),
+		}); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,160 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package partitions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// TypeESP is the GPT type of an EFI system partition
+	TypeESP = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	// TypeLinux is the GPT type of a Linux filesystem
+	TypeLinux = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+
+	gptEntries   = 128
+	gptEntrySize = 128
+	// gptSectors is the number of sectors used by the entries
+	gptSectors = gptEntries * gptEntrySize / sectorSize
+)
+
+// NewGUID returns a random (version 4) GUID
+func NewGUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])), nil
+}
+
+// ParseGUID converts a GUID into the mixed-endian form used on disk by GPT and other Microsoft formats, where
+// the first three fields are little endian
+func ParseGUID(guid string) ([16]byte, error) {
+	var b [16]byte
+	raw, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(raw) != 16 || len(guid) != 36 {
+		return b, fmt.Errorf("invalid GUID %q", guid)
+	}
+	copy(b[:], raw)
+	binary.LittleEndian.PutUint32(b[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(b[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(b[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	return b, nil
+}
+
+// WriteGPT writes a protective MBR and primary and backup GPT partition tables to a disk of size bytes. Partitions
+// must be sector aligned and are numbered in order, a random GUID is used for any partition without one.
+func WriteGPT(disk io.WriterAt, size int64, partitions []Partition) error {
+	if len(partitions) > gptEntries {
+		return fmt.Errorf("too many partitions: %d", len(partitions))
+	}
+	lastLBA := uint64(size/sectorSize) - 1
+	header := gptHeader{
+		Revision:       0x00010000,
+		HeaderSize:     92,
+		FirstUsableLBA: 2 + gptSectors,
+		LastUsableLBA:  lastLBA - 1 - gptSectors,
+		EntryCount:     gptEntries,
+		EntrySize:      gptEntrySize,
+	}
+	copy(header.Signature[:], gptSignature)
+	diskGUID, err := NewGUID()
+	if err != nil {
+		return err
+	}
+	if header.DiskGUID, err = ParseGUID(diskGUID); err != nil {
+		return err
+	}
+
+	entries := new(bytes.Buffer)
+	for i, part := range partitions {
+		if part.Start%sectorSize != 0 || part.Size%sectorSize != 0 || part.Size <= 0 {
+			return fmt.Errorf("partition %d is not sector aligned", i+1)
+		}
+		entry := gptEntry{
+			FirstLBA: uint64(part.Start / sectorSize),
+			LastLBA:  uint64((part.Start+part.Size)/sectorSize) - 1,
+		}
+		if entry.FirstLBA < header.FirstUsableLBA || entry.LastLBA > header.LastUsableLBA {
+			return fmt.Errorf("partition %d is outside of the usable space of the disk", i+1)
+		}
+		if entry.TypeGUID, err = ParseGUID(part.Type); err != nil {
+			return err
+		}
+		guid := part.GUID
+		if guid == "" {
+			if guid, err = NewGUID(); err != nil {
+				return err
+			}
+		}
+		if entry.UniqueGUID, err = ParseGUID(guid); err != nil {
+			return err
+		}
+		name := utf16.Encode([]rune(part.Name))
+		if len(name) > (gptEntrySize-gptEntryHeader)/2 {
+			return fmt.Errorf("partition name %q is too long", part.Name)
+		}
+		padded := make([]uint16, (gptEntrySize-gptEntryHeader)/2)
+		copy(padded, name)
+		binary.Write(entries, binary.LittleEndian, entry)  // nolint: errcheck
+		binary.Write(entries, binary.LittleEndian, padded) // nolint: errcheck
+	}
+	entries.Write(make([]byte, gptEntries*gptEntrySize-entries.Len()))
+	header.EntriesCRC = crc32.ChecksumIEEE(entries.Bytes())
+
+	// the backup header at the end of the disk follows its own copy of the entries
+	primary, backup := header, header
+	primary.CurrentLBA, primary.BackupLBA, primary.EntriesLBA = 1, lastLBA, 2
+	backup.CurrentLBA, backup.BackupLBA, backup.EntriesLBA = lastLBA, 1, lastLBA-gptSectors
+	for _, h := range []gptHeader{primary, backup} {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, h) // nolint: errcheck
+		binary.LittleEndian.PutUint32(buf.Bytes()[16:20], crc32.ChecksumIEEE(buf.Bytes()[:h.HeaderSize]))
+		sector := make([]byte, sectorSize)
+		copy(sector, buf.Bytes())
+		if _, err := disk.WriteAt(sector, int64(h.CurrentLBA)*sectorSize); err != nil {
+			return err
+		}
+		if _, err := disk.WriteAt(entries.Bytes(), int64(h.EntriesLBA)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	// the protective MBR covers the whole disk, so that tools which only understand MBR leave it alone
+	mbr := make([]byte, sectorSize)
+	sectors := lastLBA
+	if sectors > 0xffffffff {
+		sectors = 0xffffffff
+	}
+	protective := mbrEntry{FirstCHS: [3]byte{0, 2, 0}, Type: 0xee, LastCHS: [3]byte{0xff, 0xff, 0xff}, FirstLBA: 1, SectorsLBA: uint32(sectors)}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, protective) // nolint: errcheck
+	copy(mbr[446:], buf.Bytes())
+	mbr[510], mbr[511] = 0x55, 0xaa
+	_, err = disk.WriteAt(mbr, 0)
+	return err
+}
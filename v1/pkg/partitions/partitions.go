@@ -0,0 +1,163 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package partitions reads MBR and GPT partition tables, and writes GPT partition tables
+package partitions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+const sectorSize = 512
+
+// Partition is a partition of a disk, with its offset and size in bytes
+type Partition struct {
+	// Number of the partition, starting at 1
+	Number int
+	Start  int64
+	Size   int64
+	// Type is the GPT type GUID, or the MBR type as a hex byte e.g. 0x83
+	Type string
+	// GUID is the unique GUID of a GPT partition, i.e. its PARTUUID
+	GUID string
+	// Name is the name of a GPT partition
+	Name string
+}
+
+// gptSignature is at the start of the GPT header in the second sector
+var gptSignature = []byte("EFI PART")
+
+// mbrEntry is a primary partition in the MBR
+type mbrEntry struct {
+	Status     uint8
+	FirstCHS   [3]byte
+	Type       uint8
+	LastCHS    [3]byte
+	FirstLBA   uint32
+	SectorsLBA uint32
+}
+
+// gptHeader is the subset of the GPT header needed to read the partition entries
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	EntryCount     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+// gptEntryHeader is the size of a gptEntry, the UTF-16 name fills the rest of the entry
+const gptEntryHeader = 56
+
+// gptEntry is a GPT partition entry, without the name that follows it
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+}
+
+// Read returns the partitions of a disk with either an MBR or GPT partition table, a disk without
+// a partition table has no partitions. Only primary MBR partitions are returned.
+func Read(disk io.ReaderAt) ([]Partition, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %v", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, nil
+	}
+	var entries [4]mbrEntry
+	if err := binary.Read(bytes.NewReader(mbr[446:510]), binary.LittleEndian, &entries); err != nil {
+		return nil, err
+	}
+	var partitions []Partition
+	for i, entry := range entries {
+		if entry.Type == 0xee {
+			return readGPT(disk)
+		}
+		if entry.Type == 0 || entry.SectorsLBA == 0 {
+			continue
+		}
+		partitions = append(partitions, Partition{
+			Number: i + 1,
+			Start:  int64(entry.FirstLBA) * sectorSize,
+			Size:   int64(entry.SectorsLBA) * sectorSize,
+			Type:   fmt.Sprintf("0x%02x", entry.Type),
+		})
+	}
+	return partitions, nil
+}
+
+func readGPT(disk io.ReaderAt) ([]Partition, error) {
+	var header gptHeader
+	if err := binary.Read(io.NewSectionReader(disk, sectorSize, sectorSize), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to read GPT header: %v", err)
+	}
+	if !bytes.Equal(header.Signature[:], gptSignature) {
+		return nil, fmt.Errorf("invalid GPT header")
+	}
+	if header.EntrySize < 128 || header.EntryCount > 1024 {
+		return nil, fmt.Errorf("invalid GPT header: %d entries of %d bytes", header.EntryCount, header.EntrySize)
+	}
+	var partitions []Partition
+	for i := 0; i < int(header.EntryCount); i++ {
+		var entry gptEntry
+		offset := int64(header.EntriesLBA)*sectorSize + int64(i)*int64(header.EntrySize)
+		if err := binary.Read(io.NewSectionReader(disk, offset, int64(header.EntrySize)), binary.LittleEndian, &entry); err != nil {
+			return nil, fmt.Errorf("failed to read GPT entry %d: %v", i+1, err)
+		}
+		if entry.TypeGUID == [16]byte{} {
+			continue
+		}
+		name := make([]uint16, (header.EntrySize-gptEntryHeader)/2)
+		if err := binary.Read(io.NewSectionReader(disk, offset+gptEntryHeader, int64(header.EntrySize-gptEntryHeader)), binary.LittleEndian, name); err != nil {
+			return nil, fmt.Errorf("failed to read GPT entry %d: %v", i+1, err)
+		}
+		for len(name) > 0 && name[len(name)-1] == 0 {
+			name = name[:len(name)-1]
+		}
+		partitions = append(partitions, Partition{
+			Number: i + 1,
+			Start:  int64(entry.FirstLBA) * sectorSize,
+			Size:   int64(entry.LastLBA-entry.FirstLBA+1) * sectorSize,
+			Type:   formatGUID(entry.TypeGUID),
+			GUID:   formatGUID(entry.UniqueGUID),
+			Name:   string(utf16.Decode(name)),
+		})
+	}
+	return partitions, nil
+}
+
+// formatGUID formats a GUID stored in its mixed-endian on-disk form
+func formatGUID(b [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]), binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
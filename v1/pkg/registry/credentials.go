@@ -0,0 +1,155 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/flanksource/commons/logger"
+)
+
+// dockerConfig is the subset of ~/.docker/config.json used for registry credentials
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerConfigFile returns the path of the docker client config, respecting DOCKER_CONFIG
+func dockerConfigFile() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// LoadDockerCredentials sets the username and password from the docker client config if they are not already set,
+// either from the config itself or from the credential helper configured for the registry.
+func (r *Repository) LoadDockerCredentials() error {
+	if r.Username != "" || r.IdentityToken != "" {
+		return nil
+	}
+	file := dockerConfigFile()
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid docker config %s: %v", file, err)
+	}
+	for host, auth := range config.Auths {
+		if normalizeHost(host) != r.Host {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return fmt.Errorf("invalid auth for %s in %s: %v", host, file, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				r.Username, r.Password = parts[0], parts[1]
+				return nil
+			}
+		}
+		if auth.Username != "" {
+			r.Username, r.Password = auth.Username, auth.Password
+			return nil
+		}
+	}
+	helper := config.CredsStore
+	for host, name := range config.CredHelpers {
+		if normalizeHost(host) == r.Host {
+			helper = name
+		}
+	}
+	if helper == "" {
+		return nil
+	}
+	return r.loadHelperCredentials(helper)
+}
+
+// identityTokenUser is the username returned by credential helpers when the secret is an identity token
+const identityTokenUser = "<token>"
+
+// loadHelperCredentials gets the credentials for the registry from a docker credential helper, a registry
+// without credentials in the helper is accessed anonymously
+func (r *Repository) loadHelperCredentials(helper string) error {
+	binary := "docker-credential-" + helper
+	if _, err := exec.LookPath(binary); err != nil {
+		logger.Warnf("Credentials for %s are stored in the %s credential helper, but %s was not found", r.Host, helper, binary)
+		return nil
+	}
+	// docker hub credentials are stored under the URL used by the docker client
+	server := r.Host
+	if server == dockerHub {
+		server = "https://index.docker.io/v1/"
+	}
+	cmd := exec.Command(binary, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, "credentials not found") {
+			logger.Debugf("No credentials for %s in the %s credential helper", r.Host, helper)
+			return nil
+		}
+		return fmt.Errorf("failed to get credentials for %s from %s: %v: %s", r.Host, binary, err, output)
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return fmt.Errorf("invalid credentials for %s from %s: %v", r.Host, binary, err)
+	}
+	if creds.Username == identityTokenUser {
+		r.IdentityToken = creds.Secret
+		return nil
+	}
+	r.Username, r.Password = creds.Username, creds.Secret
+	return nil
+}
+
+// normalizeHost converts the keys used in the docker config, e.g. https://index.docker.io/v1/ into a registry host
+func normalizeHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "index.docker.io", dockerHubRegistry:
+		return dockerHub
+	}
+	return host
+}
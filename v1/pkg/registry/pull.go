@@ -0,0 +1,127 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flanksource/commons/logger"
+
+	"sigs.k8s.io/image-builder/pkg/oci"
+)
+
+// manifestTypes are the manifest media types accepted when pulling, including the docker equivalents of the OCI types
+var manifestTypes = []string{
+	oci.MediaTypeIndex,
+	oci.MediaTypeManifest,
+	oci.MediaTypeDockerManifestList,
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// GetManifest returns a manifest or index by tag or digest, along with its media type
+func (r *Repository) GetManifest(reference string) ([]byte, string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestTypes, ", ")}}
+	resp, err := r.do(http.MethodGet, r.baseURL()+"/manifests/"+url.PathEscape(reference), header, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, fmt.Sprintf("get manifest %s:%s", r, reference), http.StatusOK); err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if mediaType == "" || mediaType == "application/json" {
+		var manifest struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &manifest) // nolint: errcheck
+		mediaType = manifest.MediaType
+	}
+	return data, mediaType, nil
+}
+
+// Pull downloads the image manifest for platform, selecting it from an index if necessary, and saves its
+// config and layers to dir, named after their digest. The manifest and its digest are returned.
+func (r *Repository) Pull(reference string, platform oci.Platform, dir string) (oci.Manifest, string, error) {
+	var manifest oci.Manifest
+	data, mediaType, err := r.GetManifest(reference)
+	if err != nil {
+		return manifest, "", err
+	}
+	if mediaType == oci.MediaTypeIndex || mediaType == oci.MediaTypeDockerManifestList {
+		var index oci.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return manifest, "", fmt.Errorf("invalid index %s:%s: %v", r, reference, err)
+		}
+		desc, err := index.Find(platform)
+		if err != nil {
+			return manifest, "", fmt.Errorf("%s:%s: %v", r, reference, err)
+		}
+		if data, _, err = r.GetManifest(desc.Digest); err != nil {
+			return manifest, "", err
+		}
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, "", fmt.Errorf("invalid manifest %s:%s: %v", r, reference, err)
+	}
+	for _, blob := range append([]oci.Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := r.download(blob, dir); err != nil {
+			return manifest, "", err
+		}
+	}
+	return manifest, fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// download saves a blob to dir, verifying its digest
+func (r *Repository) download(desc oci.Descriptor, dir string) error {
+	resp, err := r.do(http.MethodGet, r.baseURL()+"/blobs/"+desc.Digest, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "download "+desc.Digest, http.StatusOK); err != nil {
+		return err
+	}
+	logger.Infof("Pulling %s (%d bytes) from %s", desc.Digest, desc.Size, r)
+	file := filepath.Join(dir, oci.BlobName(desc.Digest))
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), resp.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %v", desc.Digest, err)
+	}
+	if digest := fmt.Sprintf("sha256:%x", hash.Sum(nil)); digest != desc.Digest {
+		return fmt.Errorf("digest mismatch for %s: got %s", desc.Digest, digest)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/flanksource/commons/logger"
+
+	"sigs.k8s.io/image-builder/pkg/oci"
+)
+
+// PushArchive pushes the image in an OCI image layout tarball and tags it with each of tags, the image
+// is the manifest in the layout index tagged as ref, or the first manifest if ref is empty.
+// The digest of the pushed manifest or index is returned.
+func (r *Repository) PushArchive(file, ref string, tags []string) (string, error) {
+	archive, err := oci.OpenArchive(file)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+	index, err := archive.Index()
+	if err != nil {
+		return "", err
+	}
+	var image *oci.Descriptor
+	for i, desc := range index.Manifests {
+		if ref == "" || desc.Annotations[oci.AnnotationRefName] == ref {
+			image = &index.Manifests[i]
+			break
+		}
+	}
+	if image == nil {
+		return "", fmt.Errorf("image %s not found in %s", ref, file)
+	}
+	if err := r.push(archive, *image, 0); err != nil {
+		return "", err
+	}
+	data, err := readBlob(archive, image.Digest)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		logger.Infof("Tagging %s:%s", r, tag)
+		if err := r.putManifest(tag, image.MediaType, data); err != nil {
+			return "", err
+		}
+	}
+	return image.Digest, nil
+}
+
+// push uploads the blobs referenced by desc followed by desc itself, for an index each of its manifests are pushed first
+func (r *Repository) push(archive *oci.Archive, desc oci.Descriptor, depth int) error {
+	if depth > 8 {
+		return fmt.Errorf("index is nested too deeply")
+	}
+	data, err := readBlob(archive, desc.Digest)
+	if err != nil {
+		return err
+	}
+	switch desc.MediaType {
+	case oci.MediaTypeIndex, oci.MediaTypeDockerManifestList:
+		var index oci.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("invalid index %s: %v", desc.Digest, err)
+		}
+		for _, manifest := range index.Manifests {
+			if err := r.push(archive, manifest, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		var manifest oci.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("invalid manifest %s: %v", desc.Digest, err)
+		}
+		for _, blob := range append([]oci.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := r.pushBlob(archive, blob); err != nil {
+				return err
+			}
+		}
+	}
+	return r.putManifest(desc.Digest, desc.MediaType, data)
+}
+
+func readBlob(archive *oci.Archive, digest string) ([]byte, error) {
+	blob, err := archive.Blob(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(blob)
+}
+
+// pushBlob uploads a blob in a single request, unless the registry already has it
+func (r *Repository) pushBlob(archive *oci.Archive, desc oci.Descriptor) error {
+	resp, err := r.do(http.MethodHead, r.baseURL()+"/blobs/"+desc.Digest, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		logger.Debugf("%s already exists in %s", desc.Digest, r)
+		return nil
+	}
+
+	resp, err = r.do(http.MethodPost, r.baseURL()+"/blobs/uploads/", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "start upload of "+desc.Digest, http.StatusAccepted); err != nil {
+		return err
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("invalid upload location: %v", err)
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+
+	logger.Infof("Pushing %s (%d bytes) to %s", desc.Digest, desc.Size, r)
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err = r.do(http.MethodPut, location.String(), header, func() (io.Reader, int64, error) {
+		blob, err := archive.Blob(desc.Digest)
+		if err != nil {
+			return nil, 0, err
+		}
+		return blob, blob.Size(), nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "upload "+desc.Digest, http.StatusCreated)
+}
+
+// putManifest uploads a manifest or index, referenced by either a tag or its digest
+func (r *Repository) putManifest(reference, mediaType string, data []byte) error {
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := r.do(http.MethodPut, r.baseURL()+"/manifests/"+url.PathEscape(reference), header, func() (io.Reader, int64, error) {
+		return bytes.NewReader(data), int64(len(data)), nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "push manifest "+reference, http.StatusCreated, http.StatusOK)
+}
@@ -0,0 +1,245 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package registry pulls and pushes OCI images using the registry distribution API
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	dockerHub         = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// Repository is a repository in a registry, e.g. registry.example.com/team/image
+type Repository struct {
+	// Host of the registry, including the port if any
+	Host string
+	// Name of the repository within the registry
+	Name     string
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token used instead of the username and password, e.g. from a credential helper
+	IdentityToken string
+	// Insecure uses plain HTTP, which is always used for localhost
+	Insecure bool
+	// ReadOnly only requests pull access when authenticating
+	ReadOnly bool
+
+	client *http.Client
+	token  string
+}
+
+// ParseRepository splits a repository reference into its registry host and name, references
+// without a registry host refer to Docker Hub
+func ParseRepository(repository string) (*Repository, error) {
+	if repository == "" || strings.ContainsAny(repository, "@ ") {
+		return nil, fmt.Errorf("invalid repository %q", repository)
+	}
+	parts := strings.SplitN(repository, "/", 2)
+	repo := &Repository{Host: dockerHub, Name: repository, client: http.DefaultClient}
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		repo.Host, repo.Name = parts[0], parts[1]
+	}
+	if repo.Host == dockerHub && !strings.Contains(repo.Name, "/") {
+		repo.Name = "library/" + repo.Name
+	}
+	return repo, nil
+}
+
+func (r *Repository) String() string {
+	return r.Host + "/" + r.Name
+}
+
+func (r *Repository) baseURL() string {
+	scheme := "https"
+	host := r.Host
+	if r.Insecure || strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		scheme = "http"
+	}
+	if host == dockerHub {
+		host = dockerHubRegistry
+	}
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, host, r.Name)
+}
+
+// do sends a request, authenticating and retrying once if the registry requires it. body is called
+// to create the request body for each attempt.
+func (r *Repository) do(method, url string, header http.Header, body func() (io.Reader, int64, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		var length int64
+		if body != nil {
+			var err error
+			if reader, length, err = body(); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest(method, url, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.ContentLength = length
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", r.token)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := r.authenticate(challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate responds to a WWW-Authenticate challenge using either basic auth or a bearer token
+func (r *Repository) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.Username == "" {
+			return fmt.Errorf("%s requires credentials", r.Host)
+		}
+		r.token = "Basic " + base64.StdEncoding.EncodeToString([]byte(r.Username+":"+r.Password))
+		return nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return fmt.Errorf("invalid authentication challenge from %s: %s", r.Host, challenge)
+		}
+		query := realm.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		actions := "pull,push"
+		if r.ReadOnly {
+			actions = "pull"
+		}
+		query.Set("scope", fmt.Sprintf("repository:%s:%s", r.Name, actions))
+		var req *http.Request
+		if r.IdentityToken != "" {
+			// identity tokens are exchanged for an access token using the OAuth2 refresh token grant
+			form := url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {r.IdentityToken},
+				"service":       {params["service"]},
+				"scope":         {query.Get("scope")},
+				"client_id":     {"image-builder"},
+			}
+			req, err = http.NewRequest(http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			realm.RawQuery = query.Encode()
+			if req, err = http.NewRequest(http.MethodGet, realm.String(), nil); err != nil {
+				return err
+			}
+			if r.Username != "" {
+				req.SetBasicAuth(r.Username, r.Password)
+			}
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to authenticate to %s: %s", r.Host, resp.Status)
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return fmt.Errorf("invalid token from %s: %v", realm.Host, err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		r.token = "Bearer " + token.Token
+		return nil
+	}
+	return fmt.Errorf("unsupported authentication challenge from %s: %s", r.Host, challenge)
+}
+
+// parseChallenge parses a WWW-Authenticate header such as: Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value, rest = rest[1:end+1], rest[end+1:]
+			if len(rest) > 0 {
+				rest = rest[1:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
+
+// checkResponse returns an error including the body of the response unless its status is one of expected
+func checkResponse(resp *http.Response, action string, expected ...int) error {
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("failed to %s: %s %s", action, resp.Status, strings.TrimSpace(string(body)))
+}
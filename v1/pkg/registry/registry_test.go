@@ -0,0 +1,324 @@
+/*
+ Copyright 2020 The Kubernetes Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/image-builder/pkg/oci"
+)
+
+// testRegistry is an in-memory implementation of the parts of the registry API used to push and pull,
+// requiring basic auth when a username is set
+type testRegistry struct {
+	username, password string
+
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+}
+
+func newTestRegistry(username, password string) *testRegistry {
+	return &testRegistry{
+		username:  username,
+		password:  password,
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+	}
+}
+
+func (t *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if t.username != "" {
+		if username, password, ok := req.BasicAuth(); !ok || username != t.username || password != t.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	kind, reference := parts[len(parts)-2], parts[len(parts)-1]
+	switch {
+	case kind == "uploads" && req.Method == http.MethodPost:
+		w.Header().Set("Location", req.URL.Path+"upload-1")
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "uploads" && req.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(req.Body)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		if digest != req.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		t.blobs[digest] = data
+		w.WriteHeader(http.StatusCreated)
+	case kind == "blobs":
+		data, ok := t.blobs[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == http.MethodGet {
+			w.Write(data) // nolint: errcheck
+		}
+	case kind == "manifests" && req.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(req.Body)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		for _, ref := range []string{reference, digest} {
+			t.manifests[ref] = data
+			t.types[ref] = req.Header.Get("Content-Type")
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests":
+		data, ok := t.manifests[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", t.types[reference])
+		w.Write(data) // nolint: errcheck
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeTestImage writes an OCI image layout with a single layer for linux/amd64 and returns its path
+func writeTestImage(t *testing.T, dir string) string {
+	file := filepath.Join(dir, "image.tar")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	layout := oci.NewLayout(f)
+	config, err := layout.AddBlob(oci.MediaTypeConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := layout.AddBlob(oci.MediaTypeLayer, []byte("not really a tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := layout.AddManifest(config, []oci.Descriptor{layer}, "test", &oci.Platform{OS: "linux", Architecture: "amd64"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestPushPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-builder-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewServer(newTestRegistry("", ""))
+	defer server.Close()
+
+	repo, err := ParseRepository(strings.TrimPrefix(server.URL, "http://") + "/team/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := repo.PushArchive(writeTestImage(t, dir), "test", []string{"v1", "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"v1", "latest", digest} {
+		manifest, pulled, err := repo.Pull(tag, oci.Platform{OS: "linux", Architecture: "amd64"}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pulled != digest {
+			t.Errorf("pushed %s but pulled %s as %s", digest, tag, pulled)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, oci.BlobName(manifest.Layers[0].Digest)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "not really a tar" {
+			t.Errorf("unexpected layer contents %q", data)
+		}
+	}
+}
+
+// startRegistry runs a registry:2 container and returns its host along with a function that removes it, the test
+// is skipped if docker is not available
+func startRegistry(t *testing.T) (string, func()) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not available")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker is not running")
+	}
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::5000", "registry:2").Output()
+	if err != nil {
+		t.Skipf("failed to start registry:2: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop := func() {
+		exec.Command("docker", "rm", "-f", id).Run() // nolint: errcheck
+	}
+	out, err = exec.Command("docker", "port", id, "5000/tcp").Output()
+	if err != nil {
+		stop()
+		t.Fatalf("failed to get the registry port: %v", err)
+	}
+	host := strings.TrimSpace(strings.Split(string(out), "\n")[0])
+	for i := 0; ; i++ {
+		resp, err := http.Get("http://" + host + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return host, stop
+			}
+		}
+		if i == 50 {
+			stop()
+			t.Fatalf("registry on %s did not start: %v", host, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// TestRegistryContainer pushes to and pulls from a real registry
+func TestRegistryContainer(t *testing.T) {
+	host, stop := startRegistry(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "image-builder-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := ParseRepository(host + "/team/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := repo.PushArchive(writeTestImage(t, dir), "test", []string{"v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, mediaType, err := repo.GetManifest("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != oci.MediaTypeManifest {
+		t.Errorf("expected %s, got %s", oci.MediaTypeManifest, mediaType)
+	}
+	if fmt.Sprintf("sha256:%x", sha256.Sum256(data)) != digest {
+		t.Errorf("the registry stored a different manifest than the pushed %s", digest)
+	}
+	pull := filepath.Join(dir, "pull")
+	if err := os.Mkdir(pull, 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest, pulled, err := repo.Pull("v1", oci.Platform{OS: "linux", Architecture: "amd64"}, pull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pulled != digest {
+		t.Errorf("pushed %s but pulled %s", digest, pulled)
+	}
+	layer, err := ioutil.ReadFile(filepath.Join(pull, oci.BlobName(manifest.Layers[0].Digest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(layer) != "not really a tar" {
+		t.Errorf("unexpected layer contents %q", layer)
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-builder-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewServer(newTestRegistry("user", "secret"))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	helper := `#!/bin/sh
+read server
+if [ "$1" = get ] && [ "$server" = "` + host + `" ]; then
+  echo '{"ServerURL":"` + host + `","Username":"user","Secret":"secret"}'
+else
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"auths":{"` + host + `":{}},"credHelpers":{"` + host + `":"test"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("DOCKER_CONFIG", dir)
+
+	repo, err := ParseRepository(host + "/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.LoadDockerCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Username != "user" || repo.Password != "secret" {
+		t.Fatalf("expected the credentials from the helper, got %s:%s", repo.Username, repo.Password)
+	}
+	if _, err := repo.PushArchive(writeTestImage(t, dir), "", []string{"latest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// registries without credentials in the helper are accessed anonymously
+	other, err := ParseRepository("registry.example.com/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"credsStore":"test"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.LoadDockerCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if other.Username != "" {
+		t.Errorf("expected no credentials, got %s", other.Username)
+	}
+}